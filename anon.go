@@ -0,0 +1,129 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	// rank anonymous clients by the location of their exit, as everybody else
+	anonPolicyGeo = "geo"
+	// rank by the lat= and lon= parameters sent by the client, if any
+	anonPolicyHint = "hint"
+	// ignore the location and return a shuffled list
+	anonPolicyNeutral = "neutral"
+)
+
+type anondb struct {
+	db *geoip2.Reader
+}
+
+func openAnonDB(path string) (*anondb, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dbType := db.Metadata().DatabaseType
+	if !strings.Contains(dbType, "Anonymous-IP") {
+		db.Close()
+		return nil, fmt.Errorf("%s is a %s database, not an Anonymous-IP one", path, dbType)
+	}
+	return &anondb{db}, nil
+}
+
+// lookup returns nil when there is no anonymizer database or the lookup fails
+func (a *anondb) lookup(ip net.IP) *geoip2.AnonymousIP {
+	if a == nil || ip == nil {
+		return nil
+	}
+	record, err := a.db.AnonymousIP(ip)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+func (a *anondb) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.db.Close()
+}
+
+func isAnonymousClient(anon *geoip2.AnonymousIP) bool {
+	if anon == nil {
+		return false
+	}
+	return anon.IsAnonymous || anon.IsTorExitNode || anon.IsHostingProvider
+}
+
+func validAnonPolicy(policy string) bool {
+	switch policy {
+	case anonPolicyGeo, anonPolicyHint, anonPolicyNeutral:
+		return true
+	}
+	return false
+}
+
+// locationHint parses the lat= and lon= parameters of the request. NaN is
+// parsed fine and passes any range check, so it is rejected explicitly.
+func locationHint(req *http.Request) (float64, float64, bool) {
+	q := req.URL.Query()
+	lat, err := strconv.ParseFloat(q.Get("lat"), 64)
+	if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err := strconv.ParseFloat(q.Get("lon"), 64)
+	if err != nil || math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// neutralGateways returns every allowed gateway in random order, for clients
+// whose location we cannot trust
+func (g *geodb) neutralGateways(rng *rand.Rand) []string {
+	ret := make([]string, 0)
+	for _, gw := range randomizeGateways(rng, g.Gateways) {
+		if !g.Forbidden[gw.Host] && !stringInSlice(gw.Host, ret) {
+			ret = append(ret, gw.Host)
+		}
+	}
+	return ret
+}
+
+// sortGatewaysForClient applies the anonymizer policy before falling back to
+// the ranking strategy
+func (g *geodb) sortGatewaysForClient(req *http.Request, client *clientInfo) []string {
+	if !isAnonymousClient(client.Anonymous) || g.anonPolicy == anonPolicyGeo {
+		return g.rankerFor(client).Rank(client, g.rankingMarginFor(client.Record))
+	}
+	if g.anonPolicy == anonPolicyHint {
+		if hlat, hlon, ok := locationHint(req); ok {
+			return g.sortGateways(g.randFor(client), hlat, hlon, g.rankingMargin)
+		}
+	}
+	return g.neutralGateways(g.randFor(client))
+}
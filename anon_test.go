@@ -0,0 +1,44 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLocationHint(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"lat=48.85&lon=2.35", true},
+		{"lat=-90&lon=180", true},
+		{"lat=91&lon=0", false},
+		{"lat=0&lon=-181", false},
+		{"lat=NaN&lon=NaN", false},
+		{"lat=0&lon=nan", false},
+		{"lat=Inf&lon=0", false},
+		{"lat=48.85", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/json?"+tt.query, nil)
+		if _, _, ok := locationHint(req); ok != tt.ok {
+			t.Errorf("%q: got %t, want %t", tt.query, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type asnInfo struct {
+	Number       uint
+	Organization string
+	ISP          string
+}
+
+func (a *asnInfo) String() string {
+	return fmt.Sprintf("AS%d", a.Number)
+}
+
+// otherASN is the metrics label of the networks not in -metrics_asns
+const otherASN = "other"
+
+// asndb wraps either a GeoLite2-ASN or a commercial GeoIP2-ISP database
+type asndb struct {
+	db    *geoip2.Reader
+	isISP bool
+	// networks with their own label in the metrics
+	metricASNs map[uint]bool
+}
+
+func openASNDB(path string) (*asndb, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dbType := db.Metadata().DatabaseType
+	isISP := strings.Contains(dbType, "ISP")
+	if !isISP && !strings.Contains(dbType, "ASN") {
+		db.Close()
+		return nil, fmt.Errorf("%s is a %s database, not an ASN or ISP one", path, dbType)
+	}
+	return &asndb{db, isISP, nil}, nil
+}
+
+// parseASNs parses a comma-separated list of ASNs, with or without the AS
+// prefix
+func parseASNs(s string) (map[uint]bool, error) {
+	asns := make(map[uint]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(field)), "AS")
+		if field == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN %q", field)
+		}
+		asns[uint(n)] = true
+	}
+	return asns, nil
+}
+
+// metricLabel returns the label of the network in the metrics, bounded to
+// the configured networks so that the series don't grow with every ASN
+func (a *asndb) metricLabel(info *asnInfo) string {
+	if a.metricASNs[info.Number] {
+		return info.String()
+	}
+	return otherASN
+}
+
+// lookup returns nil when there is no ASN database or the address is unknown
+func (a *asndb) lookup(ip net.IP) *asnInfo {
+	if a == nil || ip == nil {
+		return nil
+	}
+	if a.isISP {
+		record, err := a.db.ISP(ip)
+		if err != nil || record.AutonomousSystemNumber == 0 {
+			return nil
+		}
+		return &asnInfo{record.AutonomousSystemNumber, record.AutonomousSystemOrganization, record.ISP}
+	}
+	record, err := a.db.ASN(ip)
+	if err != nil || record.AutonomousSystemNumber == 0 {
+		return nil
+	}
+	return &asnInfo{record.AutonomousSystemNumber, record.AutonomousSystemOrganization, ""}
+}
+
+func (a *asndb) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.db.Close()
+}
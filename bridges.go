@@ -0,0 +1,301 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bucketByASN    = "asn"
+	bucketByPrefix = "prefix"
+	// rate limited networks untouched for this long are forgotten
+	bucketIdle = 24 * time.Hour
+)
+
+// bridge is an unlisted gateway, only handed out to clients from censored
+// countries
+type bridge struct {
+	ID        string `json:"id"`
+	Address   string `json:"address"`
+	Transport string `json:"transport"`
+	Cert      string `json:"cert,omitempty"`
+	IatMode   int    `json:"iat_mode"`
+	Location  string `json:"location,omitempty"`
+}
+
+// bridgePool hands out to each bucket of clients, an ASN or a /16, a small
+// subset of the bridges chosen by rendezvous hashing with a secret key. A
+// bucket always gets the same bridges, adding or removing bridges changes
+// few of them, and scanning from many addresses of a bucket reveals nothing
+// more. Clients are bucketed by the address they connect from, as
+// X-Forwarded-For is only trusted from proxies, and rate limited per /24
+// (/48 for IPv6) so that a few clients can't exhaust their whole bucket.
+type bridgePool struct {
+	path      string
+	mu        sync.RWMutex
+	bridges   []bridge
+	secret    []byte
+	perBucket int
+	bucketBy  string
+	countries []string
+	proxies   []*net.IPNet
+	limiter   *bucketLimiter
+}
+
+func loadBridgePool(path string, secret []byte, perBucket int, bucketBy string, countries []string, proxies []*net.IPNet, rate float64) (*bridgePool, error) {
+	if bucketBy != bucketByASN && bucketBy != bucketByPrefix {
+		return nil, fmt.Errorf("unknown bridge bucket %q", bucketBy)
+	}
+	if perBucket <= 0 {
+		return nil, fmt.Errorf("the number of bridges per bucket must be positive")
+	}
+	p := &bridgePool{
+		path:      path,
+		secret:    secret,
+		perBucket: perBucket,
+		bucketBy:  bucketBy,
+		countries: countries,
+		proxies:   proxies,
+		limiter:   newBucketLimiter(rate),
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *bridgePool) load() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var bridges []bridge
+	if err := json.NewDecoder(f).Decode(&bridges); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", p.path, err)
+	}
+	ids := make(map[string]bool)
+	for i, b := range bridges {
+		if _, _, err := net.SplitHostPort(b.Address); err != nil {
+			return fmt.Errorf("bridge %d: invalid address %q", i+1, b.Address)
+		}
+		if b.ID == "" {
+			// the id keys the hashing, so it must not change with the position
+			bridges[i].ID = b.Address
+		}
+		if ids[bridges[i].ID] {
+			return fmt.Errorf("duplicated bridge %s", bridges[i].ID)
+		}
+		ids[bridges[i].ID] = true
+		if b.Transport == "" {
+			bridges[i].Transport = "obfs4"
+		}
+	}
+
+	p.mu.Lock()
+	p.bridges = bridges
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *bridgePool) len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.bridges)
+}
+
+// parseProxies parses a comma-separated list of addresses and networks
+func parseProxies(s string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		cidr := p
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q", p)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p *bridgePool) isProxy(ip net.IP) bool {
+	for _, network := range p.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address the client connects from. When it is one of
+// the trusted proxies, the address they forwarded for is taken instead,
+// walking X-Forwarded-For back over the chain of trusted proxies.
+func (p *bridgePool) remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && ip != nil && p.isProxy(ip); i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+// bucket returns the bucket of the address, its network if known and
+// bucketing by ASN, otherwise its /16 (/32 for IPv6)
+func (p *bridgePool) bucket(g *geodb, ip net.IP) string {
+	if p.bucketBy == bucketByASN {
+		if asn := g.asn.lookup(ip); asn != nil {
+			return asn.String()
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 8*net.IPv4len)).String() + "/16"
+	}
+	return ip.Mask(net.CIDRMask(32, 8*net.IPv6len)).String() + "/32"
+}
+
+// handOut returns the bridges for the client, nil if it is not in one of
+// the censored countries or its network went over the rate limit. The client
+// is located again if it was by an address it gave itself.
+func (p *bridgePool) handOut(g *geodb, req *http.Request, client *clientInfo) []bridge {
+	if p == nil {
+		return nil
+	}
+	ip := p.remoteIP(req)
+	if ip == nil {
+		return nil
+	}
+	country := ""
+	if !ip.Equal(net.ParseIP(client.IP)) {
+		country = g.getRecordForIP(ip.String()).Country.IsoCode
+	} else if client.Status == statusOK {
+		country = client.Record.Country.IsoCode
+	}
+	if !stringInSlice(country, p.countries) {
+		return nil
+	}
+	bucket := p.bucket(g, ip)
+	if !p.limiter.allow(cacheKey(ip), time.Now()) {
+		bridgesRateLimited.WithLabelValues(country).Inc()
+		return nil
+	}
+
+	p.mu.RLock()
+	bridges := p.bridges
+	p.mu.RUnlock()
+
+	type scored struct {
+		bridge
+		score []byte
+	}
+	candidates := make([]scored, 0, len(bridges))
+	for _, b := range bridges {
+		mac := hmac.New(sha256.New, p.secret)
+		mac.Write([]byte(bucket))
+		mac.Write([]byte{0})
+		mac.Write([]byte(b.ID))
+		candidates = append(candidates, scored{b, mac.Sum(nil)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return string(candidates[i].score) > string(candidates[j].score)
+	})
+
+	ret := make([]bridge, 0, p.perBucket)
+	for i := 0; i < len(candidates) && i < p.perBucket; i++ {
+		ret = append(ret, candidates[i].bridge)
+	}
+	// the buckets would tell who is being handed out which bridges
+	bridgesHandedOut.WithLabelValues(country).Add(float64(len(ret)))
+	return ret
+}
+
+// bucketLimiter is a token bucket per key, refilled at rate requests per
+// hour up to rate
+type bucketLimiter struct {
+	rate    float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBucketLimiter(rate float64) *bucketLimiter {
+	return &bucketLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket, always allowing if rate is 0
+func (l *bucketLimiter) allow(key string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) > bucketIdle {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.rate, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.rate, b.tokens+now.Sub(b.last).Hours()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// cacheEntry holds the lookups and the base ranking for a client network.
+// The entries are shared between requests and must not be modified once
+// added to the cache.
+type cacheEntry struct {
+	key        string
+	generation uint64
+	record     *geoip2.City
+	asn        *asnInfo
+	status     string
+	precision  string
+
+	once    sync.Once
+	nearest []gatewayLocation
+}
+
+// lookupCache is a LRU cache of lookups keyed by the /24 (IPv4) or the /48
+// (IPv6) network of the clients
+type lookupCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLookupCache(size int) *lookupCache {
+	return &lookupCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 8*net.IPv6len)).String()
+}
+
+// get returns the entry for the key, or nil if it is missing or from an
+// older generation of the databases and gateways
+func (c *lookupCache) get(key string, generation uint64) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if entry.generation == generation {
+			c.ll.MoveToFront(el)
+			cacheLookups.WithLabelValues("hit").Inc()
+			return entry
+		}
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+	cacheLookups.WithLabelValues("miss").Inc()
+	return nil
+}
+
+func (c *lookupCache) add(entry *cacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[entry.key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[entry.key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+		cacheEvictions.Inc()
+	}
+	cacheEntries.Set(float64(c.ll.Len()))
+}
+
+func (c *lookupCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	cacheEntries.Set(0)
+}
+
+// reloaded starts a new generation after the databases or the gateways
+// change, so that nothing computed with the previous ones is served
+func (g *geodb) reloaded() {
+	atomic.AddUint64(&g.generation, 1)
+	g.cache.purge()
+}
+
+func (g *geodb) currentGeneration() uint64 {
+	return atomic.LoadUint64(&g.generation)
+}
+
+// clientNearest returns the gateway locations nearest to the client, computed
+// only once per cached network
+func (g *geodb) clientNearest(client *clientInfo, margin float64) []gatewayLocation {
+	record := client.Record
+	if client.entry == nil {
+		return g.nearestFor(record.Location.Latitude, record.Location.Longitude, margin > 0)
+	}
+	client.entry.once.Do(func() {
+		client.entry.nearest = g.nearestFor(record.Location.Latitude, record.Location.Longitude, true)
+	})
+	return client.entry.nearest
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type DebugClientJSON struct {
+	IP           string   `json:"ip,omitempty"`
+	Source       string   `json:"source"`
+	Status       string   `json:"status"`
+	Precision    string   `json:"precision"`
+	Country      string   `json:"cc"`
+	City         string   `json:"city"`
+	Latitude     float64  `json:"lat"`
+	Longitude    float64  `json:"lon"`
+	Accuracy     uint16   `json:"accuracy_radius"`
+	Margin       float64  `json:"margin"`
+	Strategy     string   `json:"strategy"`
+	Regions      []string `json:"regions"`
+	Policies     []string `json:"policies"`
+	Jurisdiction string   `json:"jurisdiction,omitempty"`
+}
+
+type DebugGatewayJSON struct {
+	Host              string   `json:"host"`
+	Location          string   `json:"location"`
+	Latitude          float64  `json:"lat"`
+	Longitude         float64  `json:"lon"`
+	CoordinatesSource string   `json:"coordinates_source"`
+	Transports        []string `json:"transports"`
+	ASN               uint     `json:"asn,omitempty"`
+	Distance          float64  `json:"distance"`
+	Weight            float64  `json:"weight"`
+	Load              float64  `json:"load"`
+	Status            string   `json:"status"`
+	Position          int      `json:"position"`
+}
+
+type DebugRankingJSON struct {
+	Client   DebugClientJSON    `json:"client"`
+	Gateways []DebugGatewayJSON `json:"gateways"`
+}
+
+// debugHandler explains the ranking for an ip= or a lat=&lon= pair. It is
+// served on the metrics port, which is only reachable by operators.
+type debugHandler struct {
+	geoipdb *geodb
+}
+
+func (dh *debugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g := dh.geoipdb
+	q := req.URL.Query()
+
+	var client *clientInfo
+	source := "database"
+	if ipstr := q.Get("ip"); ipstr != "" {
+		client = g.lookupClient(ipstr)
+		switch {
+		case client.Override != nil && client.Override.hasLocation():
+			source = "override"
+		case client.Override != nil:
+			source = "override-gateways"
+		case client.Status != statusOK && g.defaultLocation != nil:
+			source = "default-location"
+		case client.Status != statusOK:
+			source = "none"
+		}
+	} else if lat, lon, ok := locationHint(req); ok {
+		record := &geoip2.City{}
+		record.Location.Latitude = lat
+		record.Location.Longitude = lon
+		client = &clientInfo{Record: record, Status: statusOK, Precision: precisionCity}
+		client.Regions = g.regions.lookup(lat, lon)
+		source = "query"
+	} else {
+		http.Error(w, "either ip= or lat= and lon= are needed", http.StatusBadRequest)
+		return
+	}
+
+	record := client.Record
+	lat, lon := record.Location.Latitude, record.Location.Longitude
+	if client.Status != statusOK && g.defaultLocation != nil {
+		lat, lon = g.defaultLocation.Latitude, g.defaultLocation.Longitude
+	}
+	strategy := g.strategy
+	if g.rankers[q.Get("strategy")] != nil {
+		strategy = q.Get("strategy")
+		client.strategy = strategy
+	}
+
+	data := &DebugRankingJSON{
+		Client: DebugClientJSON{
+			IP:        client.IP,
+			Source:    source,
+			Status:    client.Status,
+			Precision: client.Precision,
+			Country:   record.Country.IsoCode,
+			City:      record.City.Names[defaultLang],
+			Latitude:  lat,
+			Longitude: lon,
+			Accuracy:  record.Location.AccuracyRadius,
+			Margin:    g.rankingMarginFor(record),
+			Strategy:  strategy,
+			Regions:   client.Regions,
+		},
+		Gateways: make([]DebugGatewayJSON, 0),
+	}
+
+	positions := make(map[string]int)
+	client.dryRun = true
+	for i, host := range g.rankGateways(req, client) {
+		positions[host] = i + 1
+	}
+	data.Client.Policies = client.Policies
+	data.Client.Jurisdiction = client.Jurisdiction
+	for _, gw := range g.Gateways {
+		status := "active"
+		if g.Forbidden[gw.Host] {
+			status = "forbidden"
+		} else if g.invites.isPrivate(gw.Host) {
+			status = "private"
+		} else if g.maintenance.isDrained(gw.Host, time.Now()) {
+			status = "drained"
+		}
+		data.Gateways = append(data.Gateways, DebugGatewayJSON{
+			Host:              gw.Host,
+			Location:          gw.Location,
+			Latitude:          gw.Coordinates.Latitude,
+			Longitude:         gw.Coordinates.Longitude,
+			CoordinatesSource: gw.CoordinatesSource,
+			Transports:        gw.transports(),
+			ASN:               gw.ASN,
+			Distance:          g.geodesicDistance(lat, lon, gw.Coordinates),
+			Weight:            g.weight(gw.Host),
+			Load:              g.load.get(gw.Host),
+			Status:            status,
+			Position:          positions[gw.Host],
+		})
+	}
+	// ranked gateways first, in order, then the rest by distance
+	sort.SliceStable(data.Gateways, func(i, j int) bool {
+		a, b := data.Gateways[i], data.Gateways[j]
+		if (a.Position == 0) != (b.Position == 0) {
+			return a.Position != 0
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.Distance < b.Distance
+	})
+
+	if q.Get("format") == "txt" {
+		writeDebugTable(w, data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	dataJSON, _ := json.MarshalIndent(data, "", "  ")
+	w.Write(dataJSON)
+}
+
+func writeDebugTable(w http.ResponseWriter, data *DebugRankingJSON) {
+	c := data.Client
+	fmt.Fprintf(w, "Client: %s\n", c.IP)
+	fmt.Fprintf(w, "Location: %s, %s (%s, %s) from %s, precision %s, status %s\n",
+		floatToString(c.Latitude), floatToString(c.Longitude), c.City, c.Country,
+		c.Source, c.Precision, c.Status)
+	fmt.Fprintf(w, "Accuracy radius: %d km, ranking margin: %.0f km, strategy: %s\n",
+		c.Accuracy, c.Margin, c.Strategy)
+	if len(c.Regions) > 0 {
+		fmt.Fprintf(w, "Regions: %s\n", strings.Join(c.Regions, ", "))
+	}
+	if len(c.Policies) > 0 {
+		fmt.Fprintf(w, "Policies: %s\n", strings.Join(c.Policies, ", "))
+	}
+	if c.Jurisdiction != "" {
+		fmt.Fprintf(w, "Jurisdiction policy: %s\n", c.Jurisdiction)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "POS\tHOST\tLOCATION\tCOORDINATES\tSOURCE\tDISTANCE\tWEIGHT\tLOAD\tSTATUS")
+	for _, gw := range data.Gateways {
+		pos := "-"
+		if gw.Position > 0 {
+			pos = fmt.Sprint(gw.Position)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.4f,%.4f\t%s\t%.0f km\t%g\t%.2f\t%s\n",
+			pos, gw.Host, gw.Location, gw.Latitude, gw.Longitude,
+			gw.CoordinatesSource, gw.Distance, gw.Weight, gw.Load, gw.Status)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// gatewayLocation is a point where one or more gateways are, with its
+// distance in km to the client
+type gatewayLocation struct {
+	point    [3]float64
+	gateways []gateway
+	distance float64
+	// allowed is set when the forbidden gateways were already left out
+	allowed bool
+}
+
+// nearestLocations returns the gateway locations nearest first. By default
+// the kd-tree orders them by chord distance through the earth, with
+// -geodesic_ranking they are ordered by their distance along the ellipsoid.
+func (g *geodb) nearestLocations(lat float64, lon float64) []gatewayLocation {
+	locations := make([]gatewayLocation, 0)
+	if !g.geodesicRanking {
+		t := g.getPointForLocation(lat, lon)
+		nn := g.GatewayTree.KNN(t, len(g.Gateways))
+		seen := make(map[[3]float64]bool)
+		for i := 0; i < len(nn); i++ {
+			p := [3]float64{nn[i].GetValue(0), nn[i].GetValue(1), nn[i].GetValue(2)}
+			// the tree has a point per gateway, so cities show up repeated
+			if !seen[p] {
+				seen[p] = true
+				locations = append(locations, gatewayLocation{p, g.GatewayMap[p], math.Sqrt(nn[i].Distance(t)) / 1000, false})
+			}
+		}
+		return locations
+	}
+
+	for p, gws := range g.GatewayMap {
+		locations = append(locations, gatewayLocation{p, gws, g.geodesicDistance(lat, lon, gws[0].Coordinates), false})
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].distance < locations[j].distance
+	})
+	return locations
+}
+
+// geodesicDistance returns the distance in km between a point and a location
+func (g *geodb) geodesicDistance(lat float64, lon float64, to coordinates) float64 {
+	d, _ := g.earth.To(lat, lon, to.Latitude, to.Longitude)
+	return d / 1000
+}
+
+// gatewayDistances returns the geodesic distance in km from the point to each
+// of the hosts
+func (g *geodb) gatewayDistances(lat float64, lon float64, hosts []string) map[string]float64 {
+	distances := make(map[string]float64)
+	for _, gw := range g.Gateways {
+		if stringInSlice(gw.Host, hosts) {
+			distances[gw.Host] = math.Round(g.geodesicDistance(lat, lon, gw.Coordinates)*10) / 10
+		}
+	}
+	return distances
+}
+
+// maxDistance parses the max_distance= parameter, in km
+func maxDistance(req *http.Request) (float64, bool) {
+	d, err := strconv.ParseFloat(req.URL.Query().Get("max_distance"), 64)
+	if err != nil || math.IsNaN(d) || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// filterByDistance keeps only the hosts within max km, dropping the others
+// from the distances too
+func filterByDistance(hosts []string, distances map[string]float64, max float64) []string {
+	ret := make([]string, 0)
+	for _, host := range hosts {
+		if d, ok := distances[host]; ok && d <= max {
+			ret = append(ret, host)
+		} else {
+			delete(distances, host)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "strings"
+
+// diversify reorders the first n hosts so that they span distinct
+// locations, countries and networks when possible, keeping the nearest
+// first. Each position takes the best ranked host not sharing the location,
+// country and network of the hosts already picked, relaxing the network and
+// then the country when there is none.
+func (g *geodb) diversify(hosts []string, n int) []string {
+	if n <= 1 || len(hosts) <= 1 {
+		return hosts
+	}
+	byHost := make(map[string]gateway, len(g.Gateways))
+	for _, gw := range g.Gateways {
+		byHost[gw.Host] = gw
+	}
+
+	picked := make([]gateway, 0, n)
+	conflicts := func(gw gateway, level int) bool {
+		for _, p := range picked {
+			if strings.EqualFold(gw.Location, p.Location) {
+				return true
+			}
+			if level >= 2 && g.gatewayCountry(gw) != "" && g.gatewayCountry(gw) == g.gatewayCountry(p) {
+				return true
+			}
+			if level >= 3 && gw.ASN != 0 && gw.ASN == p.ASN {
+				return true
+			}
+		}
+		return false
+	}
+
+	ret := make([]string, 0, len(hosts))
+	rest := append([]string{}, hosts...)
+	for len(ret) < n && len(rest) > 0 {
+		next := 0
+	levels:
+		for level := 3; level >= 1; level-- {
+			for i, host := range rest {
+				if !conflicts(byHost[host], level) {
+					next = i
+					break levels
+				}
+			}
+		}
+		ret = append(ret, rest[next])
+		picked = append(picked, byHost[rest[next]])
+		rest = append(rest[:next], rest[next+1:]...)
+	}
+	return append(ret, rest...)
+}
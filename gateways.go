@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 const (
@@ -48,6 +49,29 @@ type gateway struct {
 	Location    string
 	IPAddress   string `json:"ip_address"`
 	Coordinates coordinates
+	// where the coordinates come from, see geolocateCity
+	CoordinatesSource string `json:"-"`
+	// autonomous system of the gateway address, 0 when unknown
+	ASN          uint `json:"-"`
+	Capabilities struct {
+		Transport []transport
+	}
+}
+
+type transport struct {
+	Type      string
+	Protocols []string
+	Ports     []string
+}
+
+// transports returns the types of transport the gateway offers, like
+// openvpn or obfs4
+func (gw gateway) transports() []string {
+	types := make([]string, 0, len(gw.Capabilities.Transport))
+	for _, t := range gw.Capabilities.Transport {
+		types = append(types, strings.ToLower(t.Type))
+	}
+	return types
 }
 
 type coordinates struct {
@@ -89,6 +113,15 @@ func (b *bonafide) fetchEipJSON() error {
 	return nil
 }
 
+// locationCountries maps each location of the eip-service to its country
+func locationCountries(eip *eipService) map[string]string {
+	countries := make(map[string]string)
+	for name, loc := range eip.Locations {
+		countries[name] = strings.ToUpper(loc.CountryCode)
+	}
+	return countries
+}
+
 func (b *bonafide) listGateways() error {
 	if b.eip == nil {
 		return fmt.Errorf("cannot list gateways, it is empty")
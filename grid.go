@@ -0,0 +1,127 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// rankingGrid holds the order of the gateway locations, nearest first, for
+// the center of every cell of a lat/lon grid. Neighbouring cells often share
+// the same order, so every distinct order is stored only once. The gateways
+// of each location are stored with the forbidden ones already left out.
+type rankingGrid struct {
+	resolution float64
+	rows       int
+	cols       int
+	points     [][3]float64
+	coords     []coordinates
+	gateways   [][]gateway
+	cells      []int32
+	orders     [][]uint16
+}
+
+// buildGrid precomputes the ranking for cells of resolution degrees
+func (g *geodb) buildGrid(resolution float64) *rankingGrid {
+	grid := &rankingGrid{
+		resolution: resolution,
+		rows:       int(math.Ceil(180 / resolution)),
+		cols:       int(math.Ceil(360 / resolution)),
+	}
+	index := make(map[[3]float64]uint16)
+	for p, gws := range g.GatewayMap {
+		index[p] = uint16(len(grid.points))
+		grid.points = append(grid.points, p)
+		grid.coords = append(grid.coords, gws[0].Coordinates)
+		allowed := make([]gateway, 0)
+		for _, gw := range gws {
+			if !g.Forbidden[gw.Host] {
+				allowed = append(allowed, gw)
+			}
+		}
+		grid.gateways = append(grid.gateways, allowed)
+	}
+
+	interned := make(map[string]int32)
+	grid.cells = make([]int32, grid.rows*grid.cols)
+	key := make([]byte, 2*len(grid.points))
+	for r := 0; r < grid.rows; r++ {
+		lat := math.Min(-90+(float64(r)+0.5)*resolution, 90)
+		for c := 0; c < grid.cols; c++ {
+			lon := math.Min(-180+(float64(c)+0.5)*resolution, 180)
+			nearest := g.nearestLocations(lat, lon)
+			order := make([]uint16, len(nearest))
+			for i, loc := range nearest {
+				order[i] = index[loc.point]
+				binary.LittleEndian.PutUint16(key[2*i:], order[i])
+			}
+			id, ok := interned[string(key)]
+			if !ok {
+				id = int32(len(grid.orders))
+				grid.orders = append(grid.orders, order)
+				interned[string(key)] = id
+			}
+			grid.cells[r*grid.cols+c] = id
+		}
+	}
+	return grid
+}
+
+func (grid *rankingGrid) cell(lat float64, lon float64) int {
+	r := int((lat + 90) / grid.resolution)
+	c := int((lon + 180) / grid.resolution)
+	if r >= grid.rows {
+		r = grid.rows - 1
+	}
+	if c >= grid.cols {
+		c = grid.cols - 1
+	}
+	if r < 0 {
+		r = 0
+	}
+	if c < 0 {
+		c = 0
+	}
+	return r*grid.cols + c
+}
+
+// gridLocations returns the gateway locations in the precomputed order of the
+// cell of the point. Their actual distance to it is only computed if asked
+// for, as it is not needed to rank without a margin.
+func (g *geodb) gridLocations(lat float64, lon float64, withDistance bool) []gatewayLocation {
+	grid := g.grid
+	order := grid.orders[grid.cells[grid.cell(lat, lon)]]
+	locations := make([]gatewayLocation, len(order))
+
+	if !withDistance {
+		for i, idx := range order {
+			locations[i] = gatewayLocation{grid.points[idx], grid.gateways[idx], 0, true}
+		}
+		return locations
+	}
+
+	t := g.getPointForLocation(lat, lon)
+	for i, idx := range order {
+		var d float64
+		if g.geodesicRanking {
+			d = g.geodesicDistance(lat, lon, grid.coords[idx])
+		} else {
+			d = math.Sqrt(t.Distance(EuclideanPoint{Vec: grid.points[idx][:]})) / 1000
+		}
+		locations[i] = gatewayLocation{grid.points[idx], grid.gateways[idx], d, true}
+	}
+	return locations
+}
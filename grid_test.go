@@ -0,0 +1,128 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/StefanSchroeder/Golang-Ellipsoid/ellipsoid"
+)
+
+var testLocations = map[string]string{
+	"amsterdam": "NL",
+	"paris":     "FR",
+	"seattle":   "US",
+	"miami":     "US",
+	"montreal":  "CA",
+	"sydney":    "AU",
+	"london":    "GB",
+	"tokyo":     "JP",
+}
+
+// newTestGeodb returns a geodb with a few gateways in every test location,
+// without the databases nor the eip-service
+func newTestGeodb(gridResolution float64) *geodb {
+	earth := ellipsoid.Init("WGS84", ellipsoid.Degrees, ellipsoid.Meter, ellipsoid.LongitudeIsSymmetric, ellipsoid.BearingIsSymmetric)
+	g := &geodb{
+		earth:          &earth,
+		Weights:        map[string]float64{},
+		gridResolution: gridResolution,
+		rand:           rand.New(rand.NewSource(1)),
+	}
+	b := &bonafide{eip: &eipService{}}
+	b.eip.Locations = make(map[string]struct {
+		CountryCode string
+		Hemisphere  string
+		Name        string
+		Timezone    string
+	})
+	locations := make([]string, 0, len(testLocations))
+	for location := range testLocations {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	for _, location := range locations {
+		loc := b.eip.Locations[location]
+		loc.CountryCode = testLocations[location]
+		b.eip.Locations[location] = loc
+		for i := 1; i <= 3; i++ {
+			b.eip.Gateways = append(b.eip.Gateways, gateway{
+				Host:     fmt.Sprintf("%s%d.example.org", location, i),
+				Location: location,
+			})
+		}
+	}
+	g.geolocateGateways(b)
+	return g
+}
+
+func benchmarkSortGateways(b *testing.B, g *geodb, margin float64) {
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lat := float64(i%170) - 85
+		lon := float64((i*7)%360) - 180
+		g.sortGateways(rng, lat, lon, margin)
+	}
+}
+
+func BenchmarkSortGateways(b *testing.B) {
+	benchmarkSortGateways(b, newTestGeodb(0), 0)
+}
+
+func BenchmarkSortGatewaysGrid(b *testing.B) {
+	benchmarkSortGateways(b, newTestGeodb(1), 0)
+}
+
+func BenchmarkSortGatewaysMargin(b *testing.B) {
+	benchmarkSortGateways(b, newTestGeodb(0), 500)
+}
+
+func BenchmarkSortGatewaysGridMargin(b *testing.B) {
+	benchmarkSortGateways(b, newTestGeodb(1), 500)
+}
+
+func TestGridMatchesTree(t *testing.T) {
+	tree := newTestGeodb(0)
+	grid := newTestGeodb(1)
+	for lat := -80.5; lat < 80; lat += 13 {
+		for lon := -179.5; lon < 180; lon += 17 {
+			// one host per location, so that the shuffle within a location
+			// doesn't matter
+			want := firstPerLocation(tree, tree.sortGateways(tree.rand, lat, lon, 0))
+			got := firstPerLocation(grid, grid.sortGateways(grid.rand, lat, lon, 0))
+			if fmt.Sprint(want) != fmt.Sprint(got) {
+				t.Errorf("%v,%v: grid order %v, tree order %v", lat, lon, got, want)
+			}
+		}
+	}
+}
+
+func firstPerLocation(g *geodb, hosts []string) []string {
+	seen := make(map[string]bool)
+	locations := make([]string, 0)
+	for _, host := range hosts {
+		for _, gw := range g.Gateways {
+			if gw.Host == host && !seen[gw.Location] {
+				seen[gw.Location] = true
+				locations = append(locations, gw.Location)
+			}
+		}
+	}
+	return locations
+}
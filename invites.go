@@ -0,0 +1,302 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inviteClaims are the claims of an invite token, which unlocks the private
+// gateways of its sets until it expires
+type inviteClaims struct {
+	ID      string   `json:"id"`
+	KeyID   string   `json:"kid"`
+	Sets    []string `json:"sets"`
+	Expires int64    `json:"exp"`
+}
+
+// inviteKey verifies the tokens signed by a key id, with a shared HMAC-SHA256
+// secret or an Ed25519 public key, both base64 encoded
+type inviteKey struct {
+	HMAC    string `json:"hmac"`
+	Ed25519 string `json:"ed25519"`
+
+	secret    []byte
+	publicKey ed25519.PublicKey
+}
+
+type invitesFile struct {
+	Keys    map[string]*inviteKey `json:"keys"`
+	Sets    map[string][]string   `json:"sets"`
+	Revoked []string              `json:"revoked"`
+}
+
+// inviteTable holds the keys to verify invite tokens with, and the sets of
+// private gateways they can unlock. Private gateways are left out of the
+// responses to the clients without a token for them.
+type inviteTable struct {
+	path    string
+	mu      sync.RWMutex
+	keys    map[string]*inviteKey
+	sets    map[string][]string
+	private map[string]bool
+	revoked map[string]bool
+}
+
+func loadInvites(path string) (*inviteTable, error) {
+	t := &inviteTable{path: path}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *inviteTable) load() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var inf invitesFile
+	if err := json.NewDecoder(f).Decode(&inf); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", t.path, err)
+	}
+	for kid, key := range inf.Keys {
+		if err := key.compile(); err != nil {
+			return fmt.Errorf("key %s: %v", kid, err)
+		}
+	}
+	private := make(map[string]bool)
+	for _, hosts := range inf.Sets {
+		for _, host := range hosts {
+			private[host] = true
+		}
+	}
+	revoked := make(map[string]bool)
+	for _, id := range inf.Revoked {
+		revoked[id] = true
+	}
+
+	t.mu.Lock()
+	t.keys = inf.Keys
+	t.sets = inf.Sets
+	t.private = private
+	t.revoked = revoked
+	t.mu.Unlock()
+	return nil
+}
+
+func (k *inviteKey) compile() error {
+	switch {
+	case k.HMAC != "" && k.Ed25519 != "":
+		return fmt.Errorf("has both an hmac secret and an ed25519 key")
+	case k.HMAC != "":
+		secret, err := base64.StdEncoding.DecodeString(k.HMAC)
+		if err != nil || len(secret) < minSecret {
+			return fmt.Errorf("the hmac secret must be base64 of at least %d bytes", minSecret)
+		}
+		k.secret = secret
+	case k.Ed25519 != "":
+		key, err := base64.StdEncoding.DecodeString(k.Ed25519)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("the ed25519 key must be base64 of %d bytes", ed25519.PublicKeySize)
+		}
+		k.publicKey = ed25519.PublicKey(key)
+	default:
+		return fmt.Errorf("needs an hmac secret or an ed25519 key")
+	}
+	return nil
+}
+
+func (k *inviteKey) verify(payload, sig []byte) bool {
+	if k.publicKey != nil {
+		return ed25519.Verify(k.publicKey, payload, sig)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), sig)
+}
+
+// verify checks the signature, expiry and revocation of a token of the form
+// base64url(claims).base64url(signature), the signature being over the
+// encoded claims
+func (t *inviteTable) verify(token string, now time.Time) (*inviteClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed")
+	}
+	var claims inviteClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return nil, fmt.Errorf("malformed")
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	key, ok := t.keys[claims.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key")
+	}
+	if !key.verify([]byte(parts[0]), sig) {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, fmt.Errorf("expired")
+	}
+	if t.revoked[claims.ID] {
+		return nil, fmt.Errorf("revoked")
+	}
+	return &claims, nil
+}
+
+// authorize returns the claims of the bearer token of the request, or nil if
+// there is none or it is not valid
+func (t *inviteTable) authorize(req *http.Request) *inviteClaims {
+	if t == nil {
+		return nil
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	claims, err := t.verify(strings.TrimSpace(auth[len("Bearer "):]), time.Now())
+	if err != nil {
+		invitesRejected.WithLabelValues(err.Error()).Inc()
+		return nil
+	}
+	invitesUsed.WithLabelValues(claims.ID).Inc()
+	return claims
+}
+
+// filter leaves out the private gateways the claims don't unlock
+func (t *inviteTable) filter(claims *inviteClaims, hosts []string) []string {
+	if t == nil {
+		return hosts
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	unlocked := make(map[string]bool)
+	if claims != nil {
+		for _, set := range claims.Sets {
+			for _, host := range t.sets[set] {
+				unlocked[host] = true
+			}
+		}
+	}
+	ret := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !t.private[host] || unlocked[host] {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
+
+func (t *inviteTable) isPrivate(host string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.private[host]
+}
+
+// readPrivateKey reads a base64 ed25519 private key, or its seed
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %v", path, err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+}
+
+// mint returns a token for the json claims, expiring after ttl if they have
+// no exp. It is signed with the hmac secret of the key id of the claims, or
+// with the ed25519 private key in keyPath if given.
+func (t *inviteTable) mint(claimsJSON string, keyPath string, ttl time.Duration) (string, error) {
+	var claims inviteClaims
+	if err := json.Unmarshal([]byte(claimsJSON), &claims); err != nil {
+		return "", fmt.Errorf("invalid claims: %v", err)
+	}
+	if claims.Expires == 0 {
+		claims.Expires = time.Now().Add(ttl).Unix()
+	}
+	for _, set := range claims.Sets {
+		if _, ok := t.sets[set]; !ok {
+			return "", fmt.Errorf("unknown gateway set %s", set)
+		}
+	}
+	var privateKey ed25519.PrivateKey
+	if keyPath != "" {
+		var err error
+		if privateKey, err = readPrivateKey(keyPath); err != nil {
+			return "", err
+		}
+	}
+
+	payload, err := json.Marshal(&claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	if privateKey != nil {
+		sig = ed25519.Sign(privateKey, []byte(encoded))
+	} else {
+		key, ok := t.keys[claims.KeyID]
+		if !ok || key.secret == nil {
+			return "", fmt.Errorf("no hmac secret for key %q", claims.KeyID)
+		}
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(encoded))
+		sig = mac.Sum(nil)
+	}
+	token := encoded + "." + base64.RawURLEncoding.EncodeToString(sig)
+	if _, err := t.verify(token, time.Now()); err != nil {
+		return "", fmt.Errorf("the token does not verify: %v", err)
+	}
+	return token, nil
+}
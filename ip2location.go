@@ -0,0 +1,303 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const ip2locationHeaderSize = 29
+
+// column of each field in the rows of the IP2Location BIN databases, indexed
+// by the database type (DB1 to DB26). Column 1 is the start of the range, 0
+// means that the database type does not have the field.
+var (
+	ip2locationCountryColumn   = [27]uint32{0, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}
+	ip2locationRegionColumn    = [27]uint32{0, 0, 0, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
+	ip2locationCityColumn      = [27]uint32{0, 0, 0, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4}
+	ip2locationLatitudeColumn  = [27]uint32{0, 0, 0, 0, 0, 5, 5, 0, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5}
+	ip2locationLongitudeColumn = [27]uint32{0, 0, 0, 0, 0, 6, 6, 0, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+)
+
+// ip2location reads the IP2Location BIN format. All the positions stored in
+// the file are 1-based, except the ones pointing to strings.
+type ip2location struct {
+	f         *os.File
+	dbType    uint8
+	columns   uint32
+	buildDate time.Time
+	ipv4Count uint32
+	ipv4Base  uint32
+	ipv6Count uint32
+	ipv6Base  uint32
+	ipv4Index uint32
+	ipv6Index uint32
+}
+
+func openIP2Location(path string) (*ip2location, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, ip2locationHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read IP2Location header: %v", err)
+	}
+	db := &ip2location{
+		f:         f,
+		dbType:    header[0],
+		columns:   uint32(header[1]),
+		buildDate: time.Date(2000+int(header[2]), time.Month(header[3]), int(header[4]), 0, 0, 0, 0, time.UTC),
+		ipv4Count: binary.LittleEndian.Uint32(header[5:]),
+		ipv4Base:  binary.LittleEndian.Uint32(header[9:]),
+		ipv6Count: binary.LittleEndian.Uint32(header[13:]),
+		ipv6Base:  binary.LittleEndian.Uint32(header[17:]),
+		ipv4Index: binary.LittleEndian.Uint32(header[21:]),
+		ipv6Index: binary.LittleEndian.Uint32(header[25:]),
+	}
+	if db.dbType == 0 || int(db.dbType) >= len(ip2locationCountryColumn) || db.columns < 2 {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a known IP2Location BIN database", path)
+	}
+	return db, nil
+}
+
+func (db *ip2location) readUint32(pos uint32) (uint32, error) {
+	data := make([]byte, 4)
+	if _, err := db.f.ReadAt(data, int64(pos)-1); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func (db *ip2location) readFloat(pos uint32) (float64, error) {
+	n, err := db.readUint32(pos)
+	return float64(math.Float32frombits(n)), err
+}
+
+// readIPv6 returns the address stored at pos, in network byte order
+func (db *ip2location) readIPv6(pos uint32) ([]byte, error) {
+	data := make([]byte, net.IPv6len)
+	if _, err := db.f.ReadAt(data, int64(pos)-1); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return data, nil
+}
+
+// readString follows the pointer stored at pos to a length-prefixed string
+func (db *ip2location) readString(pos uint32, skip uint32) (string, error) {
+	ptr, err := db.readUint32(pos)
+	if err != nil {
+		return "", err
+	}
+	ptr += skip
+	length := make([]byte, 1)
+	if _, err := db.f.ReadAt(length, int64(ptr)); err != nil {
+		return "", err
+	}
+	data := make([]byte, length[0])
+	if _, err := db.f.ReadAt(data, int64(ptr)+1); err != nil {
+		return "", err
+	}
+	if string(data) == "-" {
+		return "", nil
+	}
+	return string(data), nil
+}
+
+// findRow does a binary search for the row whose range contains the address
+// and returns its position, already pointing at the 4-byte columns
+func (db *ip2location) findRow(ip net.IP) (uint32, error) {
+	var low, high, base, rowSize uint32
+	var key []byte
+
+	if ip4 := ip.To4(); ip4 != nil {
+		num := binary.BigEndian.Uint32(ip4)
+		if num == math.MaxUint32 {
+			num--
+		}
+		key = make([]byte, 4)
+		binary.BigEndian.PutUint32(key, num)
+		base, high, rowSize = db.ipv4Base, db.ipv4Count, db.columns*4
+		if db.ipv4Index > 0 {
+			indexPos := db.ipv4Index + (num>>16)<<3
+			var err error
+			if low, err = db.readUint32(indexPos); err != nil {
+				return 0, err
+			}
+			if high, err = db.readUint32(indexPos + 4); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		if db.ipv6Count == 0 {
+			return 0, fmt.Errorf("the database has no IPv6 data")
+		}
+		key = ip.To16()
+		base, high, rowSize = db.ipv6Base, db.ipv6Count, 16+(db.columns-1)*4
+		if db.ipv6Index > 0 {
+			indexPos := db.ipv6Index + uint32(binary.BigEndian.Uint16(key))<<3
+			var err error
+			if low, err = db.readUint32(indexPos); err != nil {
+				return 0, err
+			}
+			if high, err = db.readUint32(indexPos + 4); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	readFrom := func(pos uint32) ([]byte, error) {
+		if len(key) == net.IPv6len {
+			return db.readIPv6(pos)
+		}
+		n, err := db.readUint32(pos)
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, n)
+		return data, err
+	}
+
+	for low <= high {
+		mid := (low + high) / 2
+		row := base + mid*rowSize
+		from, err := readFrom(row)
+		if err != nil {
+			return 0, err
+		}
+		to, err := readFrom(row + rowSize)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case bytes.Compare(key, from) < 0:
+			if mid == 0 {
+				return 0, fmt.Errorf("address not found")
+			}
+			high = mid - 1
+		case bytes.Compare(key, to) >= 0:
+			low = mid + 1
+		default:
+			// the columns are 4 bytes wide, the range start is 16 in IPv6
+			if len(key) == net.IPv6len {
+				row += 12
+			}
+			return row, nil
+		}
+	}
+	return 0, fmt.Errorf("address not found")
+}
+
+// column returns the position of a column of the row, or 0 if missing
+func (db *ip2location) column(row uint32, columns [27]uint32) uint32 {
+	c := columns[db.dbType]
+	if c == 0 {
+		return 0
+	}
+	return row + (c-1)*4
+}
+
+func (db *ip2location) City(ip net.IP) (*geoip2.City, error) {
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address")
+	}
+	row, err := db.findRow(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var record geoip2.City
+	if pos := db.column(row, ip2locationCountryColumn); pos != 0 {
+		if record.Country.IsoCode, err = db.readString(pos, 0); err != nil {
+			return nil, err
+		}
+		name, err := db.readString(pos, 3)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			record.Country.Names = map[string]string{defaultLang: name}
+		}
+	}
+	if pos := db.column(row, ip2locationRegionColumn); pos != 0 {
+		region, err := db.readString(pos, 0)
+		if err != nil {
+			return nil, err
+		}
+		if region != "" {
+			record.Subdivisions = append(record.Subdivisions, struct {
+				GeoNameID uint              `maxminddb:"geoname_id"`
+				IsoCode   string            `maxminddb:"iso_code"`
+				Names     map[string]string `maxminddb:"names"`
+			}{Names: map[string]string{defaultLang: region}})
+		}
+	}
+	if pos := db.column(row, ip2locationCityColumn); pos != 0 {
+		city, err := db.readString(pos, 0)
+		if err != nil {
+			return nil, err
+		}
+		if city != "" {
+			record.City.Names = map[string]string{defaultLang: city}
+		}
+	}
+
+	latPos := db.column(row, ip2locationLatitudeColumn)
+	lonPos := db.column(row, ip2locationLongitudeColumn)
+	if latPos != 0 && lonPos != 0 {
+		if record.Location.Latitude, err = db.readFloat(latPos); err != nil {
+			return nil, err
+		}
+		if record.Location.Longitude, err = db.readFloat(lonPos); err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+func (db *ip2location) status() DatabaseStatusJSON {
+	kind := dbKindCountry
+	if ip2locationCityColumn[db.dbType] != 0 {
+		kind = dbKindCity
+	}
+	var ipVersion uint = 4
+	if db.ipv6Count > 0 {
+		ipVersion = 6
+	}
+	return DatabaseStatusJSON{
+		Name:      "geo",
+		Type:      fmt.Sprintf("IP2Location-DB%d", db.dbType),
+		Kind:      kind,
+		Vendor:    "ip2location",
+		BuildDate: db.buildDate.Format(time.RFC3339),
+		IPVersion: ipVersion,
+	}
+}
+
+func (db *ip2location) Close() error {
+	return db.f.Close()
+}
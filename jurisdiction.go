@@ -0,0 +1,83 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	jurisdictionDemote  = "demote"
+	jurisdictionExclude = "exclude"
+)
+
+// jurisdictionPolicy keeps the clients of some countries away from the
+// gateways located in their own country
+type jurisdictionPolicy struct {
+	countries []string
+	mode      string
+}
+
+func parseJurisdiction(countries string, mode string) (*jurisdictionPolicy, error) {
+	if countries == "" {
+		return nil, nil
+	}
+	if mode != jurisdictionDemote && mode != jurisdictionExclude {
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	j := &jurisdictionPolicy{mode: mode}
+	for _, cc := range strings.Split(countries, ",") {
+		cc = strings.ToUpper(strings.TrimSpace(cc))
+		if len(cc) != 2 {
+			return nil, fmt.Errorf("invalid country code %q", cc)
+		}
+		j.countries = append(j.countries, cc)
+	}
+	return j, nil
+}
+
+// apply demotes or excludes the hosts in the country of the client, and
+// returns the mode when any was found
+func (j *jurisdictionPolicy) apply(g *geodb, client *clientInfo, hosts []string) ([]string, string) {
+	if j == nil {
+		return hosts, ""
+	}
+	country := client.Record.Country.IsoCode
+	if !stringInSlice(country, j.countries) {
+		return hosts, ""
+	}
+
+	byHost := make(map[string]gateway, len(g.Gateways))
+	for _, gw := range g.Gateways {
+		byHost[gw.Host] = gw
+	}
+	abroad := make([]string, 0, len(hosts))
+	inCountry := make([]string, 0)
+	for _, host := range hosts {
+		if gw, ok := byHost[host]; ok && g.gatewayCountry(gw) == country {
+			inCountry = append(inCountry, host)
+		} else {
+			abroad = append(abroad, host)
+		}
+	}
+	if len(inCountry) == 0 {
+		return hosts, ""
+	}
+	if j.mode == jurisdictionExclude {
+		return abroad, j.mode
+	}
+	return append(abroad, inCountry...), j.mode
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// latencyMatrix holds the median round trip time, in ms, from client regions
+// to gateway locations. Regions are either countries ("BR") or subdivisions
+// ("US-CA"), locations are the ones of the eip-service ("miami").
+type latencyMatrix struct {
+	path string
+	mu   sync.RWMutex
+	rtt  map[string]map[string]float64
+}
+
+func loadLatencyMatrix(path string) (*latencyMatrix, error) {
+	m := &latencyMatrix{path: path}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *latencyMatrix) load() error {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var matrix map[string]map[string]float64
+	if err := json.NewDecoder(f).Decode(&matrix); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", m.path, err)
+	}
+	rtt := make(map[string]map[string]float64, len(matrix))
+	for region, row := range matrix {
+		normalized := make(map[string]float64, len(row))
+		for location, ms := range row {
+			if ms < 0 {
+				return fmt.Errorf("negative rtt from %s to %s", region, location)
+			}
+			normalized[strings.ToLower(location)] = ms
+		}
+		rtt[strings.ToUpper(region)] = normalized
+	}
+
+	m.mu.Lock()
+	m.rtt = rtt
+	m.mu.Unlock()
+	return nil
+}
+
+// row returns the round trip times for the most specific region of the
+// record, or nil if there is no data for it
+func (m *latencyMatrix) row(record *geoip2.City) map[string]float64 {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cc := record.Country.IsoCode
+	for _, sub := range record.Subdivisions {
+		if row, ok := m.rtt[cc+"-"+sub.IsoCode]; ok {
+			return row
+		}
+	}
+	return m.rtt[cc]
+}
+
+// sortGatewaysByLatency orders the gateway locations with a known round trip
+// time from the client region by it, followed by the others by distance. It
+// returns false if there is no latency data for the client region.
+func (g *geodb) sortGatewaysByLatency(client *clientInfo, margin float64) ([]string, bool) {
+	row := g.latency.row(client.Record)
+	if row == nil {
+		return nil, false
+	}
+
+	known := make([]gatewayLocation, 0)
+	unknown := make([]gatewayLocation, 0)
+	for _, loc := range g.clientNearest(client, margin) {
+		if len(loc.gateways) == 0 {
+			continue
+		}
+		if ms, ok := row[strings.ToLower(loc.gateways[0].Location)]; ok {
+			known = append(known, gatewayLocation{loc.point, loc.gateways, ms, loc.allowed})
+		} else {
+			unknown = append(unknown, loc)
+		}
+	}
+	sort.SliceStable(known, func(i, j int) bool {
+		return known[i].distance < known[j].distance
+	})
+	rng := g.randFor(client)
+	return append(g.orderGateways(rng, known, g.latencyMargin), g.orderGateways(rng, unknown, margin)...), true
+}
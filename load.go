@@ -0,0 +1,76 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// gateways without a reported load count as half loaded
+const unknownLoad = 0.5
+
+// gatewayLoad holds the current load of the gateways, between 0 and 1, as
+// written by the monitoring into a json file of host: load
+type gatewayLoad struct {
+	path string
+	mu   sync.RWMutex
+	load map[string]float64
+}
+
+func loadGatewayLoad(path string) (*gatewayLoad, error) {
+	l := &gatewayLoad{path: path}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *gatewayLoad) reload() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var load map[string]float64
+	if err := json.NewDecoder(f).Decode(&load); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", l.path, err)
+	}
+	for host, v := range load {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("load of %s must be between 0 and 1", host)
+		}
+	}
+
+	l.mu.Lock()
+	l.load = load
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *gatewayLoad) get(host string) float64 {
+	if l == nil {
+		return unknownLoad
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if v, ok := l.load[host]; ok {
+		return v
+	}
+	return unknownLoad
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const defaultLang = "en"
+
+type ExtendedJSON struct {
+	Lang               string            `json:"lang"`
+	Continent          string            `json:"continent"`
+	ContinentName      string            `json:"continent_name"`
+	CountryName        string            `json:"country_name"`
+	CityName           string            `json:"city_name"`
+	Subdivisions       []SubdivisionJSON `json:"subdivisions"`
+	PostalCode         string            `json:"postal_code"`
+	TimeZone           string            `json:"time_zone"`
+	AccuracyRadius     uint16            `json:"accuracy_radius"`
+	RegisteredCountry  string            `json:"registered_country"`
+	RepresentedCountry string            `json:"represented_country"`
+	IsInEuropeanUnion  bool              `json:"is_in_european_union"`
+}
+
+type SubdivisionJSON struct {
+	IsoCode string `json:"iso_code"`
+	Name    string `json:"name"`
+}
+
+// wantsExtended reports whether the client asked for the extended response
+func wantsExtended(req *http.Request) bool {
+	ext, err := strconv.ParseBool(req.URL.Query().Get("extended"))
+	return err == nil && ext
+}
+
+// requestLanguages returns the languages preferred by the client, the lang=
+// parameter first and then the Accept-Language header ordered by quality
+func requestLanguages(req *http.Request) []string {
+	langs := make([]string, 0)
+	if lang := req.URL.Query().Get("lang"); lang != "" {
+		langs = append(langs, lang)
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	accepted := make([]weighted, 0)
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+	for _, a := range accepted {
+		langs = append(langs, a.tag)
+	}
+	return append(langs, defaultLang)
+}
+
+// matchLanguage picks the first of the preferred languages that the names map
+// has a translation for. An exact match wins, otherwise the base language is
+// compared, so that "pt" finds "pt-BR" and "zh-TW" finds "zh-CN".
+func matchLanguage(langs []string, names map[string]string) string {
+	for _, lang := range langs {
+		for key := range names {
+			if strings.EqualFold(key, lang) {
+				return key
+			}
+		}
+		base := strings.ToLower(strings.SplitN(lang, "-", 2)[0])
+		for key := range names {
+			if strings.ToLower(strings.SplitN(key, "-", 2)[0]) == base {
+				return key
+			}
+		}
+	}
+	return defaultLang
+}
+
+func localizedName(lang string, names map[string]string) string {
+	if name, ok := names[lang]; ok {
+		return name
+	}
+	return names[defaultLang]
+}
+
+func newExtendedJSON(record *geoip2.City, langs []string) *ExtendedJSON {
+	lang := matchLanguage(langs, record.Country.Names)
+
+	subdivisions := make([]SubdivisionJSON, 0)
+	for _, s := range record.Subdivisions {
+		subdivisions = append(subdivisions, SubdivisionJSON{s.IsoCode, localizedName(lang, s.Names)})
+	}
+
+	return &ExtendedJSON{
+		Lang:               lang,
+		Continent:          record.Continent.Code,
+		ContinentName:      localizedName(lang, record.Continent.Names),
+		CountryName:        localizedName(lang, record.Country.Names),
+		CityName:           localizedName(lang, record.City.Names),
+		Subdivisions:       subdivisions,
+		PostalCode:         record.Postal.Code,
+		TimeZone:           record.Location.TimeZone,
+		AccuracyRadius:     record.Location.AccuracyRadius,
+		RegisteredCountry:  record.RegisteredCountry.IsoCode,
+		RepresentedCountry: record.RepresentedCountry.IsoCode,
+		IsInEuropeanUnion:  record.Country.IsInEuropeanUnion,
+	}
+}
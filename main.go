@@ -58,12 +58,43 @@ func getRemoteIP(req *http.Request) string {
 }
 
 type geodb struct {
-	db          *geoip2.Reader
-	Forbidden   []string
+	db          geoBackend
+	Forbidden   map[string]bool
 	Gateways    []gateway
 	GatewayTree *kdtree.KDTree
 	GatewayMap  map[[3]float64][]gateway
 	earth       *ellipsoid.Ellipsoid
+	asn         *asndb
+	anon        *anondb
+	anonPolicy  string
+	overrides   *overrideTable
+
+	defaultLocation *coordinates
+	Weights         map[string]float64
+	rankingMargin   float64
+	accuracyRanking bool
+	geodesicRanking bool
+	gridResolution  float64
+	grid            *rankingGrid
+	cache           *lookupCache
+	generation      uint64
+	latency         *latencyMatrix
+	latencyMargin   float64
+	load            *gatewayLoad
+	rand            *rand.Rand
+	rankers         map[string]Ranker
+	strategy        string
+	policy          *routingPolicy
+	jurisdiction    *jurisdictionPolicy
+	regions         *regionIndex
+	diversity       int
+	sticky          *stickyKeys
+	maintenance     *maintenanceSchedule
+	quotas          *gatewayQuotas
+	bridges         *bridgePool
+	invites         *inviteTable
+
+	LocationCountries map[string]string
 }
 
 func (g *geodb) getPointForLocation(lat float64, lon float64) *EuclideanPoint {
@@ -72,32 +103,68 @@ func (g *geodb) getPointForLocation(lat float64, lon float64) *EuclideanPoint {
 	return p
 }
 
-func randomizeGateways(gws []gateway) []gateway {
+func randomizeGateways(rng *rand.Rand, gws []gateway) []gateway {
 	dest := make([]gateway, len(gws))
-	perm := rand.Perm(len(gws))
+	perm := rng.Perm(len(gws))
 	for i, v := range perm {
 		dest[v] = gws[i]
 	}
 	return dest
 }
 
-func (g *geodb) sortGateways(lat float64, lon float64) []string {
-	ret := make([]string, 0)
-	t := g.getPointForLocation(lat, lon)
-	nn := g.GatewayTree.KNN(t, len(g.Gateways))
-	for i := 0; i < len(nn); i++ {
-		p := [3]float64{nn[i].GetValue(0), nn[i].GetValue(1), nn[i].GetValue(2)}
-		cityGateways := g.GatewayMap[p]
-		if len(cityGateways) > 1 {
-			cityGateways = randomizeGateways(cityGateways)
-		}
-		for _, gw := range cityGateways {
-			if !stringInSlice(gw.Host, g.Forbidden) {
-				if !stringInSlice(gw.Host, ret) {
-					ret = append(ret, gw.Host)
+// sortGateways returns the gateways nearest first
+func (g *geodb) sortGateways(rng *rand.Rand, lat float64, lon float64, margin float64) []string {
+	return g.orderGateways(rng, g.nearestFor(lat, lon, margin > 0), margin)
+}
+
+// nearestFor returns the gateway locations nearest first, from the grid if
+// there is one
+func (g *geodb) nearestFor(lat float64, lon float64, withDistance bool) []gatewayLocation {
+	if g.grid != nil {
+		return g.gridLocations(lat, lon, withDistance)
+	}
+	return g.nearestLocations(lat, lon)
+}
+
+// orderGateways turns the sorted gateway locations into a list of hosts.
+// Gateways whose distance is within margin km of the first one of their band
+// are considered equally near, and shuffled together according to their
+// weights.
+func (g *geodb) orderGateways(rng *rand.Rand, nearest []gatewayLocation, margin float64) []string {
+	return g.orderGatewaysWith(rng, nearest, margin, g.weightedShuffle)
+}
+
+// orderGatewaysWith is orderGateways with another way of ordering the
+// gateways that are equally near
+func (g *geodb) orderGatewaysWith(rng *rand.Rand, nearest []gatewayLocation, margin float64, shuffle func(*rand.Rand, []gateway) []gateway) []string {
+	ret := make([]string, 0, len(g.Gateways))
+	seen := make(map[string]bool, len(g.Gateways))
+	for i := 0; i < len(nearest); {
+		bandStart := nearest[i].distance
+		band := make([]gateway, 0)
+		for j := i; i < len(nearest); i++ {
+			if i > j && (margin <= 0 || nearest[i].distance-bandStart > margin) {
+				break
+			}
+			if nearest[i].allowed {
+				band = append(band, nearest[i].gateways...)
+				continue
+			}
+			for _, gw := range nearest[i].gateways {
+				if !g.Forbidden[gw.Host] {
+					band = append(band, gw)
 				}
 			}
 		}
+		if len(band) > 1 {
+			band = shuffle(rng, band)
+		}
+		for _, gw := range band {
+			if !seen[gw.Host] {
+				seen[gw.Host] = true
+				ret = append(ret, gw.Host)
+			}
+		}
 	}
 	return ret
 }
@@ -117,8 +184,12 @@ func (g *geodb) geolocateGateways(b *bonafide) {
 
 	for i := 0; i < len(b.eip.Gateways); i++ {
 		gw := b.eip.Gateways[i]
-		coord := geolocateCity(gw.Location)
+		coord, source := geolocateCity(gw.Location)
 		gw.Coordinates = coord
+		gw.CoordinatesSource = source
+		if asn := g.getASNForIP(gw.IPAddress); asn != nil {
+			gw.ASN = asn.Number
+		}
 		b.eip.Gateways[i] = gw
 
 		p := g.getPointForLocation(coord.Latitude, coord.Longitude)
@@ -129,19 +200,171 @@ func (g *geodb) geolocateGateways(b *bonafide) {
 		g.GatewayMap[i] = append(g.GatewayMap[i], gw)
 	}
 	g.Gateways = b.eip.Gateways
+	g.LocationCountries = locationCountries(b.eip)
 	g.GatewayTree = kdtree.NewKDTree(gatewayPoints)
+
+	if g.gridResolution > 0 {
+		start := time.Now()
+		g.grid = g.buildGrid(g.gridResolution)
+		log.Printf("Precomputed ranking grid of %dx%d cells with %d distinct orders in %v",
+			g.grid.rows, g.grid.cols, len(g.grid.orders), time.Since(start))
+	}
+	g.reloaded()
+}
+
+// clientInfo is everything we know about the address of a client
+type clientInfo struct {
+	IP           string
+	Record       *geoip2.City
+	ASN          *asnInfo
+	Anonymous    *geoip2.AnonymousIP
+	Override     *override
+	Status       string
+	Reserved     string
+	Precision    string
+	Regions      []string
+	Policies     []string
+	Jurisdiction string
+	Invite       *inviteClaims
+
+	// strategy and dryRun are set by /debug/ranking, to try another ranking
+	// strategy and to rank without any side effect on the metrics, the
+	// rotation or the shared random generator
+	strategy string
+	dryRun   bool
+	entry    *cacheEntry
+}
+
+func (g *geodb) lookupClient(ipstr string) *clientInfo {
+	client := g.locateClient(ipstr)
+	// region and country locations are often centroids, which would put
+	// every client of the region or country in whatever region holds them
+	if client.Status == statusOK && client.Precision == precisionCity {
+		client.Regions = g.regions.lookup(client.Record.Location.Latitude, client.Record.Location.Longitude)
+	}
+	return client
+}
+
+// locateClient resolves the location of the client from the overrides, the
+// cache or the databases
+func (g *geodb) locateClient(ipstr string) *clientInfo {
+	client := &clientInfo{IP: ipstr, Status: statusOK, Precision: precisionNone}
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		client.Record = &geoip2.City{}
+		client.Status = statusUnknown
+		return client
+	}
+
+	client.Override = g.overrides.lookup(ip)
+	if client.Override != nil && client.Override.hasLocation() {
+		client.Record = client.Override.record()
+	} else if client.Reserved = reservedRange(ip); client.Reserved != "" {
+		client.Record = &geoip2.City{}
+		client.Status = statusUnroutable
+		return client
+	} else if client.Override == nil {
+		// overrides can be more specific than the cached networks, so only
+		// database lookups are cached
+		g.lookupCached(client, ip)
+		return client
+	} else {
+		client.Record = g.getRecordForIP(ipstr)
+	}
+	client.Precision = fillLocation(client.Record)
+	if client.Override != nil && client.Override.Latitude != nil {
+		client.Precision = precisionCity
+	}
+	if client.Precision == precisionNone {
+		client.Status = statusUnknown
+	}
+	client.ASN = g.getASNForIP(ipstr)
+	client.Anonymous = g.getAnonymousForIP(ipstr)
+	return client
+}
+
+// lookupCached fills the client from the cache entry of its network, looking
+// the address up in the databases on a miss
+func (g *geodb) lookupCached(client *clientInfo, ip net.IP) {
+	key := cacheKey(ip)
+	generation := g.currentGeneration()
+	entry := g.cache.get(key, generation)
+	if entry == nil {
+		entry = &cacheEntry{key: key, generation: generation, status: statusOK}
+		entry.record = g.getRecordForIP(client.IP)
+		entry.precision = fillLocation(entry.record)
+		if entry.precision == precisionNone {
+			entry.status = statusUnknown
+		}
+		entry.asn = g.getASNForIP(client.IP)
+		g.cache.add(entry)
+	}
+	if g.cache != nil {
+		client.entry = entry
+	}
+	client.Record = entry.record
+	client.ASN = entry.asn
+	client.Status = entry.status
+	client.Precision = entry.precision
+	// anonymizers come and go within a network, so they are never cached
+	client.Anonymous = g.getAnonymousForIP(client.IP)
+}
+
+// rankGateways returns the gateways sorted for the client, honoring the
+// overrides and the policies for clients without a trustable location. The
+// private gateways the client has no invite for are left out, and then come
+// the routing and jurisdiction policies, leaving out the gateways in
+// maintenance and demoting the first one if it is over its quota. The first
+// gateways of what is left are diversified last.
+func (g *geodb) rankGateways(req *http.Request, client *clientInfo) []string {
+	var hosts []string
+	pinned := client.Override != nil && len(client.Override.Gateways) > 0
+	switch {
+	case pinned:
+		hosts = g.pinnedGateways(client.Override.Gateways)
+	case client.Status != statusOK:
+		hosts = g.unlocatedGateways(g.randFor(client))
+	default:
+		hosts = g.sortGatewaysForClient(req, client)
+	}
+	hosts = g.invites.filter(client.Invite, hosts)
+	hosts, client.Policies = g.policy.apply(g, client, hosts)
+	hosts, client.Jurisdiction = g.jurisdiction.apply(g, client, hosts)
+	hosts = g.quotas.apply(client, g.maintenance.drain(hosts))
+	if !pinned {
+		hosts = g.diversify(hosts, g.diversity)
+	}
+	return hosts
 }
 
 func (g *geodb) getRecordForIP(ipstr string) *geoip2.City {
 	ip := net.ParseIP(ipstr)
 	record, err := g.db.City(ip)
 	if err != nil {
-		log.Fatal(err)
+		// failures are routine and their errors can hold the address, which
+		// must not end up in the logs
+		lookupFailures.Inc()
+		return &geoip2.City{}
 	}
 	return record
 }
 
-func geolocateCity(city string) coordinates {
+func (g *geodb) getASNForIP(ipstr string) *asnInfo {
+	return g.asn.lookup(net.ParseIP(ipstr))
+}
+
+func (g *geodb) getAnonymousForIP(ipstr string) *geoip2.AnonymousIP {
+	return g.anon.lookup(net.ParseIP(ipstr))
+}
+
+const (
+	coordinatesFromCities  = "cities"
+	coordinatesFromMissing = "missing-cities"
+	coordinatesUnknown     = "unknown"
+)
+
+// geolocateCity returns the coordinates of the city, and where they come from
+func geolocateCity(city string) (coordinates, string) {
 	// because some cities apparently are not good enough for the top 10k
 	missingCities := make(map[string]coordinates)
 	missingCities["hongkong"] = coordinates{22.319201099, 114.1696121}
@@ -151,15 +374,15 @@ func geolocateCity(city string) coordinates {
 		canonical := strings.ToLower(city)
 		canonical = re.ReplaceAllString(canonical, "")
 		if strings.ToLower(c.City) == canonical {
-			return coordinates{c.Latitude, c.Longitude}
+			return coordinates{c.Latitude, c.Longitude}, coordinatesFromCities
 		}
 		v, ok := missingCities[canonical]
 		if ok == true {
-			return v
+			return v, coordinatesFromMissing
 		}
 
 	}
-	return coordinates{0, 0}
+	return coordinates{0, 0}, coordinatesUnknown
 }
 
 type jsonHandler struct {
@@ -167,32 +390,86 @@ type jsonHandler struct {
 }
 
 type GeolocationJSON struct {
-	Ip        string   `json:"ip"`
-	Cc        string   `json:"cc"`
-	City      string   `json:"city"`
-	Latitude  float64  `json:"lat"`
-	Longitude float64  `json:"lon"`
-	Gateways  []string `json:"gateways"`
+	Ip           string             `json:"ip"`
+	Status       string             `json:"status"`
+	Reserved     string             `json:"reserved,omitempty"`
+	Precision    string             `json:"precision"`
+	Cc           string             `json:"cc"`
+	City         string             `json:"city"`
+	Latitude     float64            `json:"lat"`
+	Longitude    float64            `json:"lon"`
+	Gateways     []string           `json:"gateways"`
+	Distances    map[string]float64 `json:"distances,omitempty"`
+	Asn          uint               `json:"asn,omitempty"`
+	AsOrg        string             `json:"as_org,omitempty"`
+	Isp          string             `json:"isp,omitempty"`
+	Anonymous    bool               `json:"is_anonymous,omitempty"`
+	TorExit      bool               `json:"is_tor_exit,omitempty"`
+	Hosting      bool               `json:"is_hosting,omitempty"`
+	Override     string             `json:"override,omitempty"`
+	Regions      []string           `json:"regions,omitempty"`
+	Jurisdiction string             `json:"jurisdiction,omitempty"`
+	Bridges      []bridge           `json:"bridges,omitempty"`
+	*ExtendedJSON
 }
 
 func (jh *jsonHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ipstr := getRemoteIP(req)
-	record := jh.geoipdb.getRecordForIP(ipstr)
-	sortedGateways := jh.geoipdb.sortGateways(record.Location.Latitude, record.Location.Longitude)
+	client := jh.geoipdb.lookupClient(ipstr)
+	client.Invite = jh.geoipdb.invites.authorize(req)
+	record, asn, anon := client.Record, client.ASN, client.Anonymous
+	sortedGateways := jh.geoipdb.rankGateways(req, client)
+	var distances map[string]float64
+	if client.Status == statusOK {
+		distances = jh.geoipdb.gatewayDistances(record.Location.Latitude, record.Location.Longitude, sortedGateways)
+		if max, ok := maxDistance(req); ok {
+			sortedGateways = filterByDistance(sortedGateways, distances, max)
+		}
+	}
+	jh.geoipdb.quotas.record(client, sortedGateways)
 
 	hitsPerCountry.With(prometheus.Labels{"country": record.Country.IsoCode}).Inc()
+	if asn != nil {
+		hitsPerASN.With(prometheus.Labels{"asn": jh.geoipdb.asn.metricLabel(asn)}).Inc()
+	}
+	for _, region := range client.Regions {
+		hitsPerRegion.With(prometheus.Labels{"region": region}).Inc()
+	}
 
 	data := &GeolocationJSON{
-		ipstr,
-		record.Country.IsoCode,
-		record.City.Names["en"],
-		record.Location.Latitude,
-		record.Location.Longitude,
-		sortedGateways,
+		Ip:           ipstr,
+		Status:       client.Status,
+		Reserved:     client.Reserved,
+		Precision:    client.Precision,
+		Cc:           record.Country.IsoCode,
+		City:         record.City.Names["en"],
+		Latitude:     record.Location.Latitude,
+		Longitude:    record.Location.Longitude,
+		Gateways:     sortedGateways,
+		Distances:    distances,
+		Regions:      client.Regions,
+		Jurisdiction: client.Jurisdiction,
+		Bridges:      jh.geoipdb.bridges.handOut(jh.geoipdb, req, client),
+	}
+	if asn != nil {
+		data.Asn = asn.Number
+		data.AsOrg = asn.Organization
+		data.Isp = asn.ISP
+	}
+	if anon != nil {
+		data.Anonymous = anon.IsAnonymous
+		data.TorExit = anon.IsTorExitNode
+		data.Hosting = anon.IsHostingProvider
+	}
+	if client.Override != nil {
+		data.Override = client.Override.CIDR
+	}
+	if wantsExtended(req) {
+		data.ExtendedJSON = newExtendedJSON(record, requestLanguages(req))
 	}
 
 	dataJSON, _ := json.Marshal(data)
-	fmt.Fprintf(w, string(dataJSON))
+	w.Write(dataJSON)
 }
 
 type txtHandler struct {
@@ -201,29 +478,158 @@ type txtHandler struct {
 
 func (th *txtHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ipstr := getRemoteIP(req)
-	record := th.geoipdb.getRecordForIP(ipstr)
+	client := th.geoipdb.lookupClient(ipstr)
+	record := client.Record
 
 	fmt.Fprintf(w, "Your IP: %s\n", ipstr)
+	switch client.Status {
+	case statusUnroutable:
+		fmt.Fprintf(w, "Your Location: unroutable (%s)\n", client.Reserved)
+		return
+	case statusUnknown:
+		fmt.Fprintf(w, "Your Location: unknown\n")
+		return
+	}
 	fmt.Fprintf(w, "Your Country: %s\n", record.Country.IsoCode)
 	fmt.Fprintf(w, "Your City: %s\n", record.City.Names["en"])
 	fmt.Fprintf(w, "Your Coordinates: %s, %s\n",
 		floatToString(record.Location.Latitude),
 		floatToString(record.Location.Longitude))
+	fmt.Fprintf(w, "Your Location Precision: %s\n", client.Precision)
+	if asn := client.ASN; asn != nil {
+		fmt.Fprintf(w, "Your ASN: %s (%s)\n", asn, asn.Organization)
+		if asn.ISP != "" {
+			fmt.Fprintf(w, "Your ISP: %s\n", asn.ISP)
+		}
+	}
+	if anon := client.Anonymous; isAnonymousClient(anon) {
+		fmt.Fprintf(w, "Anonymizer: anonymous=%t tor_exit=%t hosting=%t\n",
+			anon.IsAnonymous, anon.IsTorExitNode, anon.IsHostingProvider)
+	}
+	if client.Override != nil {
+		fmt.Fprintf(w, "Override: %s\n", client.Override.CIDR)
+	}
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
 	var port = flag.Int("port", 9001, "port where the service listens on")
 	var metricsPort = flag.Int("metricsPort", 9002, "port where the metrics server listens on")
-	var dbpath = flag.String("geodb", "/var/lib/GeoIP/GeoLite2-City.mmdb", "path to the GeoLite2-City database")
+	var dbpath = flag.String("geodb", "/var/lib/GeoIP/GeoLite2-City.mmdb", "path to the GeoLite2-City, GeoLite2-Country or DB-IP Lite database")
+	var dbformat = flag.String("geodb_format", "mmdb", "format of the -geodb database: mmdb or ip2location")
+	var asnpath = flag.String("asndb", "", "optional path to the GeoLite2-ASN or GeoIP2-ISP database")
+	var metricASNs = flag.String("metrics_asns", "", "comma-separated list of ASNs counted on their own in the metrics, the rest are counted as other")
+	var anonpath = flag.String("anondb", "", "optional path to the GeoIP2-Anonymous-IP database")
+	var anonPolicy = flag.String("anonymous_policy", anonPolicyGeo, "how to rank gateways for anonymous clients: geo, hint or neutral")
 	var notls = flag.Bool("notls", false, "disable TLS on the service")
 	var key = flag.String("server_key", "", "path to the key file for TLS")
 	var crt = flag.String("server_crt", "", "path to the cert file for TLS")
 	var forbidstr = flag.String("forbid", "", "comma-separated list of forbidden gateways")
+	var overridespath = flag.String("overrides", "", "optional path to a json file of CIDR location overrides")
+	var defaultLocation = flag.String("default_location", "", "lat,lon used to rank gateways for clients with an unknown or unroutable address")
+	var weightstr = flag.String("gateway_weights", "", "comma-separated list of host:weight pairs, the default weight is 1")
+	var rankingMargin = flag.Float64("ranking_margin", 0, "distance in km under which gateways are considered equally near")
+	var accuracyRanking = flag.Bool("accuracy_ranking", false, "widen the ranking margin to the accuracy radius of the client location")
+	var geodesicRanking = flag.Bool("geodesic_ranking", false, "rank gateways by their geodesic distance instead of the chord distance")
+	var gridResolution = flag.Float64("grid_resolution", 0, "size in degrees of the cells of the precomputed ranking grid, 0 disables it")
+	var cacheSize = flag.Int("cache_size", 0, "number of client networks whose lookups are cached, 0 disables the cache")
+	var latencypath = flag.String("latency_matrix", "", "optional path to a json file of round trip times from client regions to gateway locations")
+	var latencyMargin = flag.Float64("latency_margin", 0, "difference in ms under which gateways are considered equally fast")
+	var loadpath = flag.String("gateway_load", "", "optional path to a json file with the current load of each gateway, between 0 and 1")
+	var strategy = flag.String("strategy", "", "ranking strategy: nearest, weighted-nearest, load-aware, latency, round-robin or random")
+	var policypath = flag.String("policy", "", "optional path to a json file of per-country routing policies")
+	var checkPolicyOnly = flag.Bool("check_policy", false, "check the -policy file against the current gateways and exit")
+	var jurisdictionCountries = flag.String("jurisdiction_countries", "", "comma-separated list of client countries kept away from the gateways in their own country")
+	var jurisdictionMode = flag.String("jurisdiction_policy", jurisdictionDemote, "what to do with the in-country gateways of -jurisdiction_countries clients: demote or exclude")
+	var regionspath = flag.String("regions", "", "optional path to a GeoJSON file of named regions, usable in the -policy rules")
+	var diversity = flag.Int("diversity", 0, "number of top gateways spread over distinct locations, countries and networks, 0 disables it")
+	var stickyPeriod = flag.Duration("sticky_period", 0, "keep the order of equally ranked gateways stable per client network for this long, 0 disables it")
+	var stickySecret = flag.String("sticky_secret", "", "optional path to a file with the secret keying the -sticky_period orders, a random one is used if not set")
+	var maintenancepath = flag.String("maintenance", "", "optional path to a json file of gateway maintenance windows")
+	var quotaspath = flag.String("quotas", "", "optional path to a json file of soft quotas on the first positions of the gateways")
+	var bridgespath = flag.String("bridges", "", "optional path to a json file of unlisted bridges for censored countries")
+	var bridgeSecret = flag.String("bridge_secret", "", "path to a file with the secret choosing the bridges of each bucket of clients")
+	var bridgeCountries = flag.String("bridge_countries", "", "comma-separated list of client countries that get bridges")
+	var bridgeBucket = flag.String("bridge_bucket", bucketByASN, "how to bucket clients for the bridges: asn, or prefix for their /16")
+	var bridgesPerBucket = flag.Int("bridges_per_bucket", 2, "number of bridges handed out to each bucket of clients")
+	var bridgeProxies = flag.String("bridge_proxies", "", "comma-separated addresses or networks of the reverse proxies trusted to set X-Forwarded-For for the bridges")
+	var bridgeRate = flag.Float64("bridge_rate", 60, "requests per hour a /24 (/48) network of clients can get bridges in, 0 for no limit")
+	var invitespath = flag.String("invites", "", "optional path to a json file of invite token keys and the private gateway sets they unlock")
+	var mintInvite = flag.String("mint_invite", "", "print an invite token for the given json claims, signed with the -invites key, and exit")
+	var invitePrivateKey = flag.String("invite_private_key", "", "path to the base64 ed25519 private key -mint_invite signs with, for ed25519 keys")
+	var inviteTTL = flag.Duration("invite_ttl", 30*24*time.Hour, "validity of the tokens from -mint_invite whose claims have no exp")
+	var reloadInterval = flag.Duration("reload_interval", time.Minute, "how often to check the configuration files for changes")
 	flag.Parse()
 
-	forbidden := strings.Split(*forbidstr, ",")
-	fmt.Println("Forbidden gateways:", forbidden)
+	if !validAnonPolicy(*anonPolicy) {
+		log.Fatal("-anonymous_policy must be one of geo, hint or neutral")
+	}
+
+	var defaultCoords *coordinates
+	if *defaultLocation != "" {
+		var err error
+		defaultCoords, err = parseLocation(*defaultLocation)
+		if err != nil {
+			log.Fatal("invalid -default_location: ", err)
+		}
+	}
+
+	weights, err := parseWeights(*weightstr)
+	if err != nil {
+		log.Fatal("invalid -gateway_weights: ", err)
+	}
+
+	var policy *routingPolicy
+	if *policypath != "" {
+		policy, err = loadRoutingPolicy(*policypath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d routing policy rules", len(policy.rules))
+	}
+	if *checkPolicyOnly {
+		if policy == nil {
+			log.Fatal("-check_policy needs a -policy file")
+		}
+		b := newBonafide()
+		if _, err := b.getGateways(); err != nil {
+			log.Fatal(err)
+		}
+		if !checkPolicy(policy, b.eip.Gateways, locationCountries(b.eip)) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	jurisdiction, err := parseJurisdiction(*jurisdictionCountries, *jurisdictionMode)
+	if err != nil {
+		log.Fatal("invalid -jurisdiction_countries or -jurisdiction_policy: ", err)
+	}
+
+	var invites *inviteTable
+	if *invitespath != "" {
+		invites, err = loadInvites(*invitespath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *mintInvite != "" {
+		if invites == nil {
+			log.Fatal("-mint_invite needs an -invites file")
+		}
+		token, err := invites.mint(*mintInvite, *invitePrivateKey, *inviteTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		os.Exit(0)
+	}
+
+	forbiddenHosts := strings.Split(*forbidstr, ",")
+	fmt.Println("Forbidden gateways:", forbiddenHosts)
+	forbidden := make(map[string]bool, len(forbiddenHosts))
+	for _, host := range forbiddenHosts {
+		forbidden[host] = true
+	}
 
 	if *notls == false {
 		if *key == "" || *crt == "" {
@@ -237,20 +643,214 @@ func main() {
 		}
 	}
 
-	db, err := geoip2.Open(*dbpath)
+	var db geoBackend
+	switch *dbformat {
+	case "mmdb":
+		db, err = openMMDB(*dbpath)
+	case "ip2location":
+		db, err = openIP2Location(*dbpath)
+	default:
+		log.Fatal("-geodb_format must be one of mmdb or ip2location")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	dbStatus := db.status()
+	log.Printf("Using %s database (%s)", dbStatus.Type, dbStatus.Kind)
+
+	var asn *asndb
+	if *asnpath != "" {
+		asn, err = openASNDB(*asnpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		asn.metricASNs, err = parseASNs(*metricASNs)
+		if err != nil {
+			log.Fatal("invalid -metrics_asns: ", err)
+		}
+		defer asn.Close()
+	}
+
+	var anon *anondb
+	if *anonpath != "" {
+		anon, err = openAnonDB(*anonpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer anon.Close()
+	}
+
+	var overrides *overrideTable
+	if *overridespath != "" {
+		overrides, err = loadOverrides(*overridespath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d location overrides", overrides.len())
+	}
+
+	var latency *latencyMatrix
+	if *latencypath != "" {
+		latency, err = loadLatencyMatrix(*latencypath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var load *gatewayLoad
+	if *loadpath != "" {
+		load, err = loadGatewayLoad(*loadpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var regions *regionIndex
+	if *regionspath != "" {
+		regions, err = loadRegions(*regionspath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d regions", regions.len())
+	}
+
+	var sticky *stickyKeys
+	if *stickyPeriod > 0 {
+		sticky, err = newStickyKeys(*stickySecret, *stickyPeriod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	maintenance, err := newMaintenanceSchedule(*maintenancepath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var quotas *gatewayQuotas
+	if *quotaspath != "" {
+		quotas, err = loadGatewayQuotas(*quotaspath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var bridges *bridgePool
+	if *bridgespath != "" {
+		if *bridgeSecret == "" {
+			log.Fatal("-bridges needs a -bridge_secret")
+		}
+		secret, err := readSecret(*bridgeSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		countries := make([]string, 0)
+		for _, cc := range strings.Split(*bridgeCountries, ",") {
+			if cc = strings.ToUpper(strings.TrimSpace(cc)); cc != "" {
+				countries = append(countries, cc)
+			}
+		}
+		proxies, err := parseProxies(*bridgeProxies)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bridges, err = loadBridgePool(*bridgespath, secret, *bridgesPerBucket, *bridgeBucket, countries, proxies, *bridgeRate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d bridges for %v", bridges.len(), countries)
+	}
+
+	var cache *lookupCache
+	if *cacheSize > 0 {
+		cache = newLookupCache(*cacheSize)
+	}
 
 	earth := ellipsoid.Init("WGS84", ellipsoid.Degrees, ellipsoid.Meter, ellipsoid.LongitudeIsSymmetric, ellipsoid.BearingIsSymmetric)
-	geoipdb := geodb{db, forbidden, nil, nil, nil, &earth}
+	geoipdb := geodb{
+		db:              db,
+		Forbidden:       forbidden,
+		earth:           &earth,
+		asn:             asn,
+		anon:            anon,
+		anonPolicy:      *anonPolicy,
+		overrides:       overrides,
+		defaultLocation: defaultCoords,
+		Weights:         weights,
+		rankingMargin:   *rankingMargin,
+		accuracyRanking: *accuracyRanking,
+		geodesicRanking: *geodesicRanking,
+		gridResolution:  *gridResolution,
+		cache:           cache,
+		latency:         latency,
+		latencyMargin:   *latencyMargin,
+		load:            load,
+		rand:            rand.New(newLockedSource(time.Now().UnixNano())),
+		strategy:        *strategy,
+		policy:          policy,
+		jurisdiction:    jurisdiction,
+		regions:         regions,
+		diversity:       *diversity,
+		sticky:          sticky,
+		maintenance:     maintenance,
+		quotas:          quotas,
+		bridges:         bridges,
+		invites:         invites,
+	}
+	geoipdb.rankers = newRankers(&geoipdb)
+	if geoipdb.strategy == "" {
+		geoipdb.strategy = strategyWeightedNearest
+		if latency != nil {
+			geoipdb.strategy = strategyLatency
+		}
+	}
+	if _, ok := geoipdb.rankers[geoipdb.strategy]; !ok {
+		log.Fatal("unknown ranking strategy: ", geoipdb.strategy)
+	}
 
 	log.Println("Seeding gateway list...")
 	bonafide := newBonafide()
 	bonafide.getGateways()
 
 	geoipdb.geolocateGateways(bonafide)
+
+	if overrides != nil {
+		watchFile(*overridespath, *reloadInterval, func() error {
+			if err := overrides.load(); err != nil {
+				return err
+			}
+			geoipdb.reloaded()
+			return nil
+		})
+	}
+	if latency != nil {
+		watchFile(*latencypath, *reloadInterval, latency.load)
+	}
+	if load != nil {
+		watchFile(*loadpath, *reloadInterval, load.reload)
+	}
+	if policy != nil {
+		watchFile(*policypath, *reloadInterval, policy.load)
+	}
+	if regions != nil {
+		watchFile(*regionspath, *reloadInterval, regions.load)
+	}
+	if invites != nil {
+		watchFile(*invitespath, *reloadInterval, invites.load)
+	}
+	if bridges != nil {
+		watchFile(*bridgespath, *reloadInterval, bridges.load)
+	}
+	if quotas != nil {
+		watchFile(*quotaspath, *reloadInterval, quotas.load)
+	}
+	if *maintenancepath != "" {
+		watchFile(*maintenancepath, *reloadInterval, maintenance.load)
+	}
+	if sticky != nil && *stickySecret != "" {
+		watchFile(*stickySecret, *reloadInterval, sticky.load)
+	}
 	bonafide.listGateways()
 
 	mux := http.NewServeMux()
@@ -260,8 +860,14 @@ func main() {
 	th := &txtHandler{&geoipdb}
 	mux.Handle("/", th)
 
+	sh := &statusHandler{&geoipdb}
+	mux.Handle("/status", sh)
+
 	mtr := http.NewServeMux()
 	mtr.Handle("/metrics", promhttp.Handler())
+	mtr.Handle("/debug/ranking", &debugHandler{&geoipdb})
+	mtr.Handle("/maintenance", &maintenanceHandler{&geoipdb})
+	mtr.Handle("/maintenance/status", &maintenanceStatusHandler{&geoipdb})
 
 	/* prometheus metrics */
 	go func() {
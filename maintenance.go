@@ -0,0 +1,323 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how far ahead the status shows the upcoming windows
+	maintenanceHorizon = 7 * 24 * time.Hour
+	// longest duration of a recurring window
+	maxMaintenanceDuration = 7 * 24 * time.Hour
+)
+
+// maintenanceWindow drains a gateway, either once from start to end or
+// every time the cron spec fires, for duration. Cron specs are in UTC.
+type maintenanceWindow struct {
+	ID       string     `json:"id"`
+	Host     string     `json:"host"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Cron     string     `json:"cron,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+
+	schedule *cronSchedule
+	length   time.Duration
+}
+
+func (w *maintenanceWindow) compile() error {
+	if w.Host == "" {
+		return fmt.Errorf("window without host")
+	}
+	switch {
+	case w.Cron != "" && w.Start != nil:
+		return fmt.Errorf("window for %s has both a cron spec and a start", w.Host)
+	case w.Cron != "":
+		schedule, err := parseCron(w.Cron)
+		if err != nil {
+			return err
+		}
+		length, err := time.ParseDuration(w.Duration)
+		if err != nil || length <= 0 || length > maxMaintenanceDuration {
+			return fmt.Errorf("invalid duration %q for %s", w.Duration, w.Host)
+		}
+		w.schedule, w.length = schedule, length
+	case w.Start != nil && w.End != nil:
+		if !w.End.After(*w.Start) {
+			return fmt.Errorf("window for %s ends before it starts", w.Host)
+		}
+	default:
+		return fmt.Errorf("window for %s needs a start and an end, or a cron spec and a duration", w.Host)
+	}
+	return nil
+}
+
+// activeAt returns the occurrence of the window that contains now, if any
+func (w *maintenanceWindow) activeAt(now time.Time) (time.Time, time.Time, bool) {
+	if w.schedule == nil {
+		return *w.Start, *w.End, !now.Before(*w.Start) && now.Before(*w.End)
+	}
+	now = now.UTC()
+	for t := now.Truncate(time.Minute); t.Add(w.length).After(now); t = t.Add(-time.Minute) {
+		if w.schedule.matches(t) {
+			return t, t.Add(w.length), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// nextAfter returns the first occurrence of the window starting after now and
+// before the horizon, if any
+func (w *maintenanceWindow) nextAfter(now time.Time, horizon time.Duration) (time.Time, time.Time, bool) {
+	if w.schedule == nil {
+		return *w.Start, *w.End, w.Start.After(now) && w.Start.Before(now.Add(horizon))
+	}
+	now = now.UTC()
+	limit := now.Add(horizon)
+	for t := now.Truncate(time.Minute).Add(time.Minute); t.Before(limit); t = t.Add(time.Minute) {
+		if w.schedule.matches(t) {
+			return t, t.Add(w.length), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// maintenanceSchedule holds the windows of the -maintenance file and the ones
+// added through the admin API, which are lost on restart. The drained hosts
+// are computed once per minute.
+type maintenanceSchedule struct {
+	path   string
+	mu     sync.Mutex
+	file   []*maintenanceWindow
+	api    []*maintenanceWindow
+	nextID int
+
+	minute  time.Time
+	drained map[string]bool
+}
+
+func newMaintenanceSchedule(path string) (*maintenanceSchedule, error) {
+	m := &maintenanceSchedule{path: path}
+	if path == "" {
+		return m, nil
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *maintenanceSchedule) load() error {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var windows []*maintenanceWindow
+	if err := json.NewDecoder(f).Decode(&windows); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", m.path, err)
+	}
+	for i, w := range windows {
+		if err := w.compile(); err != nil {
+			return err
+		}
+		if w.ID == "" || strings.HasPrefix(w.ID, "api-") {
+			w.ID = fmt.Sprintf("file-%d", i+1)
+		}
+	}
+
+	m.mu.Lock()
+	m.file = windows
+	m.drained = nil
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *maintenanceSchedule) add(w *maintenanceWindow) error {
+	if err := w.compile(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	w.ID = fmt.Sprintf("api-%d", m.nextID)
+	m.api = append(m.api, w)
+	m.drained = nil
+	return nil
+}
+
+// remove deletes a window added through the admin API
+func (m *maintenanceSchedule) remove(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, w := range m.api {
+		if w.ID == id {
+			m.api = append(m.api[:i], m.api[i+1:]...)
+			m.drained = nil
+			return true
+		}
+	}
+	return false
+}
+
+func (m *maintenanceSchedule) windows() []*maintenanceWindow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append(append([]*maintenanceWindow{}, m.file...), m.api...)
+}
+
+// isDrained reports whether the host is in maintenance
+func (m *maintenanceSchedule) isDrained(host string, now time.Time) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	minute := now.Truncate(time.Minute)
+	if m.drained == nil || !minute.Equal(m.minute) {
+		m.minute = minute
+		m.drained = make(map[string]bool)
+		for _, ws := range [][]*maintenanceWindow{m.file, m.api} {
+			for _, w := range ws {
+				if _, _, ok := w.activeAt(now); ok {
+					m.drained[w.Host] = true
+				}
+			}
+		}
+	}
+	return m.drained[host]
+}
+
+// drain leaves out the hosts in maintenance
+func (m *maintenanceSchedule) drain(hosts []string) []string {
+	if m == nil {
+		return hosts
+	}
+	now := time.Now()
+	ret := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if !m.isDrained(host, now) {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
+
+type MaintenanceWindowJSON struct {
+	ID        string `json:"id"`
+	Host      string `json:"host"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Recurring bool   `json:"recurring"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type MaintenanceJSON struct {
+	Active   []MaintenanceWindowJSON `json:"active"`
+	Upcoming []MaintenanceWindowJSON `json:"upcoming"`
+}
+
+// status returns the windows in progress and the ones starting within the
+// horizon, by start time
+func (m *maintenanceSchedule) status(now time.Time) *MaintenanceJSON {
+	status := &MaintenanceJSON{make([]MaintenanceWindowJSON, 0), make([]MaintenanceWindowJSON, 0)}
+	for _, w := range m.windows() {
+		if start, end, ok := w.activeAt(now); ok {
+			status.Active = append(status.Active, newMaintenanceWindowJSON(w, start, end))
+		}
+		if start, end, ok := w.nextAfter(now, maintenanceHorizon); ok {
+			status.Upcoming = append(status.Upcoming, newMaintenanceWindowJSON(w, start, end))
+		}
+	}
+	for _, list := range [][]MaintenanceWindowJSON{status.Active, status.Upcoming} {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Start < list[j].Start
+		})
+	}
+	return status
+}
+
+func newMaintenanceWindowJSON(w *maintenanceWindow, start, end time.Time) MaintenanceWindowJSON {
+	return MaintenanceWindowJSON{
+		ID:        w.ID,
+		Host:      w.Host,
+		Start:     start.UTC().Format(time.RFC3339),
+		End:       end.UTC().Format(time.RFC3339),
+		Recurring: w.schedule != nil,
+		Reason:    w.Reason,
+	}
+}
+
+// maintenanceHandler is the admin API of the maintenance windows, served on
+// the metrics port. GET lists the windows, POST adds one and DELETE removes
+// the one given by id=.
+type maintenanceHandler struct {
+	geoipdb *geodb
+}
+
+func (mh *maintenanceHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m := mh.geoipdb.maintenance
+	w.Header().Set("Content-Type", "application/json")
+
+	switch req.Method {
+	case http.MethodGet:
+		dataJSON, _ := json.Marshal(m.windows())
+		w.Write(dataJSON)
+	case http.MethodPost:
+		var window maintenanceWindow
+		if err := json.NewDecoder(req.Body).Decode(&window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.add(&window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		dataJSON, _ := json.Marshal(&window)
+		w.Write(dataJSON)
+	case http.MethodDelete:
+		if !m.remove(req.URL.Query().Get("id")) {
+			http.Error(w, "no such window added through the api", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maintenanceStatusHandler serves the windows in progress and the upcoming
+// ones on the metrics port, as the schedule is not for the public
+type maintenanceStatusHandler struct {
+	geoipdb *geodb
+}
+
+func (mh *maintenanceStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dataJSON, _ := json.Marshal(mh.geoipdb.maintenance.status(time.Now()))
+	w.Write(dataJSON)
+}
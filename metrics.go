@@ -11,3 +11,95 @@ var hitsPerCountry = promauto.NewCounterVec(prometheus.CounterOpts{
 },
 	[]string{"country"},
 )
+
+var hitsPerASN = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_hits_asn",
+	Help: "Number of hits in the geolocation service per autonomous system",
+},
+	[]string{"asn"},
+)
+
+var hitsPerRegion = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_hits_region",
+	Help: "Number of hits in the geolocation service per region of the -regions file",
+},
+	[]string{"region"},
+)
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_cache_lookups",
+	Help: "Number of lookups in the per-network cache, by result",
+},
+	[]string{"result"},
+)
+
+var cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "getmyip_cache_evictions",
+	Help: "Number of entries evicted from the per-network cache",
+})
+
+var lookupFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "getmyip_lookup_failures",
+	Help: "Number of client addresses the geolocation database failed to look up",
+})
+
+var cacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "getmyip_cache_entries",
+	Help: "Number of entries in the per-network cache",
+})
+
+var policyHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_policy_hits",
+	Help: "Number of times each routing policy rule applied",
+},
+	[]string{"rule"},
+)
+
+var policySkips = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_policy_skips",
+	Help: "Number of times each routing policy rule was skipped as it would leave no gateway",
+},
+	[]string{"rule"},
+)
+
+var quotaPressure = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "getmyip_quota_pressure",
+	Help: "Share of the first positions of a gateway over its quota, by country or all of them",
+},
+	[]string{"host", "country"},
+)
+
+var quotaDemotions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_quota_demotions",
+	Help: "Number of times a gateway over its quota gave up the first position",
+},
+	[]string{"host"},
+)
+
+var bridgesHandedOut = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_bridges_handed_out",
+	Help: "Number of bridges handed out per client country",
+},
+	[]string{"country"},
+)
+
+var bridgesRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_bridges_rate_limited",
+	Help: "Number of requests per client country that got no bridges because of the rate limit",
+},
+	[]string{"country"},
+)
+
+var invitesUsed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_invites_used",
+	Help: "Number of requests with a valid invite token, per token id",
+},
+	[]string{"token"},
+)
+
+var invitesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "getmyip_invites_rejected",
+	Help: "Number of requests with an invalid invite token, by reason",
+},
+	[]string{"reason"},
+)
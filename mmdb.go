@@ -0,0 +1,181 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	dbKindCity    = "city"
+	dbKindCountry = "country"
+
+	dbVendorMaxMind = "maxmind"
+	dbVendorDBIP    = "dbip"
+)
+
+// geoBackend resolves addresses into records in the GeoIP2 City layout, so
+// that the ranking and the handlers do not depend on the database format
+type geoBackend interface {
+	City(ip net.IP) (*geoip2.City, error)
+	status() DatabaseStatusJSON
+	Close() error
+}
+
+// mmdb reads any database in the MaxMind DB format that carries at least the
+// country of the address. geoip2.Open refuses the database types it does not
+// know about (like the DB-IP ones), so we use the maxminddb reader directly.
+type mmdb struct {
+	reader *maxminddb.Reader
+	kind   string
+	vendor string
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	kind, vendor, err := detectDatabase(reader.Metadata.DatabaseType)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return &mmdb{reader, kind, vendor}, nil
+}
+
+// knownDatabases are the database types we know the layout of, by the
+// database_type of their metadata
+var knownDatabases = map[string][2]string{
+	"GeoLite2-City":                         {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-City":                           {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-City-Africa":                    {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-City-Asia-Pacific":              {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-City-Europe":                    {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-City-North-America":             {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-City-South-America":             {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-Precision-City":                 {dbKindCity, dbVendorMaxMind},
+	"GeoIP2-Enterprise":                     {dbKindCity, dbVendorMaxMind},
+	"GeoLite2-Country":                      {dbKindCountry, dbVendorMaxMind},
+	"GeoIP2-Country":                        {dbKindCountry, dbVendorMaxMind},
+	"DBIP-City-Lite":                        {dbKindCity, dbVendorDBIP},
+	"DBIP-Location (compat=City)":           {dbKindCity, dbVendorDBIP},
+	"DBIP-Location-ISP (compat=Enterprise)": {dbKindCity, dbVendorDBIP},
+	"DBIP-Country-Lite":                     {dbKindCountry, dbVendorDBIP},
+	"DBIP-Country (compat=Country)":         {dbKindCountry, dbVendorDBIP},
+}
+
+// detectDatabase returns the kind and vendor of a database type, refusing
+// the ones we don't know the layout of
+func detectDatabase(dbType string) (string, string, error) {
+	if known, ok := knownDatabases[dbType]; ok {
+		return known[0], known[1], nil
+	}
+	return "", "", fmt.Errorf("unsupported geolocation database type: %s", dbType)
+}
+
+// dbipRecord is the layout of the DB-IP city and country databases. They
+// have no accuracy radius, registered or represented country, and the lite
+// editions have no geoname ids besides the country and continent ones.
+type dbipRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code      string            `maxminddb:"code"`
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Country struct {
+		GeoNameID         uint              `maxminddb:"geoname_id"`
+		IsInEuropeanUnion bool              `maxminddb:"is_in_european_union"`
+		IsoCode           string            `maxminddb:"iso_code"`
+		Names             map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+// city maps the DB-IP record into the GeoIP2 City layout
+func (r *dbipRecord) city() *geoip2.City {
+	var record geoip2.City
+	record.City.Names = r.City.Names
+	record.Continent.Code = r.Continent.Code
+	record.Continent.GeoNameID = r.Continent.GeoNameID
+	record.Continent.Names = r.Continent.Names
+	record.Country.GeoNameID = r.Country.GeoNameID
+	record.Country.IsInEuropeanUnion = r.Country.IsInEuropeanUnion
+	record.Country.IsoCode = r.Country.IsoCode
+	record.Country.Names = r.Country.Names
+	record.Location.Latitude = r.Location.Latitude
+	record.Location.Longitude = r.Location.Longitude
+	record.Location.TimeZone = r.Location.TimeZone
+	record.Postal.Code = r.Postal.Code
+	for _, s := range r.Subdivisions {
+		record.Subdivisions = append(record.Subdivisions, struct {
+			GeoNameID uint              `maxminddb:"geoname_id"`
+			IsoCode   string            `maxminddb:"iso_code"`
+			Names     map[string]string `maxminddb:"names"`
+		}{IsoCode: s.IsoCode, Names: s.Names})
+	}
+	return &record
+}
+
+// City returns the record for the address in the GeoIP2 City layout.
+// Records of country databases have no location, lookupClient places them
+// at the center of the country.
+func (m *mmdb) City(ip net.IP) (*geoip2.City, error) {
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address")
+	}
+	if m.vendor == dbVendorDBIP {
+		var record dbipRecord
+		if err := m.reader.Lookup(ip, &record); err != nil {
+			return nil, err
+		}
+		return record.city(), nil
+	}
+	var record geoip2.City
+	if err := m.reader.Lookup(ip, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (m *mmdb) status() DatabaseStatusJSON {
+	st := databaseStatus("geo", m.reader.Metadata)
+	st.Kind = m.kind
+	st.Vendor = m.vendor
+	return st
+}
+
+func (m *mmdb) Close() error {
+	return m.reader.Close()
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// override replaces the database answer for a network. It either places the
+// clients somewhere, pins them to a fixed list of gateways, or both.
+type override struct {
+	CIDR      string   `json:"cidr"`
+	Country   string   `json:"country"`
+	City      string   `json:"city"`
+	Latitude  *float64 `json:"lat"`
+	Longitude *float64 `json:"lon"`
+	Gateways  []string `json:"gateways"`
+}
+
+func (o *override) hasLocation() bool {
+	return o.Country != "" || (o.Latitude != nil && o.Longitude != nil)
+}
+
+// record builds a database record out of the override
+func (o *override) record() *geoip2.City {
+	record := &geoip2.City{}
+	record.Country.IsoCode = o.Country
+	if o.City != "" {
+		record.City.Names = map[string]string{defaultLang: o.City}
+	}
+	if o.Latitude != nil && o.Longitude != nil {
+		record.Location.Latitude = *o.Latitude
+		record.Location.Longitude = *o.Longitude
+	}
+	return record
+}
+
+type overrideTable struct {
+	path string
+	mu   sync.RWMutex
+	tree *prefixTree
+}
+
+func loadOverrides(path string) (*overrideTable, error) {
+	t := &overrideTable{path: path}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load parses the overrides file, a json list of override objects, and swaps
+// the current table only if the whole file is valid
+func (t *overrideTable) load() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var overrides []*override
+	if err := json.NewDecoder(f).Decode(&overrides); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", t.path, err)
+	}
+	tree := newPrefixTree()
+	for _, o := range overrides {
+		_, network, err := net.ParseCIDR(o.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid override: %v", err)
+		}
+		if (o.Latitude == nil) != (o.Longitude == nil) {
+			return fmt.Errorf("override for %s must have both lat and lon", o.CIDR)
+		}
+		if !o.hasLocation() && len(o.Gateways) == 0 {
+			return fmt.Errorf("override for %s has neither a location nor gateways", o.CIDR)
+		}
+		o.Country = strings.ToUpper(o.Country)
+		tree.insert(network, o)
+	}
+
+	t.mu.Lock()
+	t.tree = tree
+	t.mu.Unlock()
+	return nil
+}
+
+// lookup returns the most specific override for the address, or nil
+func (t *overrideTable) lookup(ip net.IP) *override {
+	if t == nil || ip == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, value := t.tree.lookup(ip)
+	if value == nil {
+		return nil
+	}
+	return value.(*override)
+}
+
+func (t *overrideTable) len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tree.len()
+}
+
+// pinnedGateways filters the forbidden gateways out of a fixed list
+func (g *geodb) pinnedGateways(hosts []string) []string {
+	ret := make([]string, 0)
+	for _, host := range hosts {
+		if !g.Forbidden[host] && !stringInSlice(host, ret) {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
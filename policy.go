@@ -0,0 +1,313 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	policyAllow  = "allow"
+	policyDeny   = "deny"
+	policyPrefer = "prefer"
+	policyPin    = "pin"
+)
+
+// gatewaySet selects gateways by host, by location, by the country they
+// are in or by the transports they offer
+type gatewaySet struct {
+	Hosts      []string `json:"hosts"`
+	Locations  []string `json:"locations"`
+	Countries  []string `json:"countries"`
+	Transports []string `json:"transports"`
+}
+
+func (s *gatewaySet) contains(gw gateway, country string) bool {
+	if stringInSlice(gw.Host, s.Hosts) ||
+		stringInSlice(strings.ToLower(gw.Location), s.Locations) ||
+		stringInSlice(country, s.Countries) {
+		return true
+	}
+	for _, t := range gw.transports() {
+		if stringInSlice(t, s.Transports) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *gatewaySet) empty() bool {
+	return len(s.Hosts) == 0 && len(s.Locations) == 0 && len(s.Countries) == 0 &&
+		len(s.Transports) == 0
+}
+
+// policyRule applies an action on a set of gateways, either a named pool or
+// an inline set, for the clients of some countries, regions and/or networks
+type policyRule struct {
+	Name      string      `json:"name"`
+	Countries []string    `json:"countries"`
+	ASNs      []uint      `json:"asns"`
+	ASNRanges [][2]uint   `json:"asn_ranges"`
+	Regions   []string    `json:"regions"`
+	Action    string      `json:"action"`
+	Pool      string      `json:"pool"`
+	Gateways  *gatewaySet `json:"gateways"`
+
+	set *gatewaySet
+}
+
+func (r *policyRule) matches(client *clientInfo) bool {
+	if len(r.Countries) > 0 && !stringInSlice("*", r.Countries) &&
+		!stringInSlice(client.Record.Country.IsoCode, r.Countries) {
+		return false
+	}
+	if len(r.Regions) > 0 {
+		found := false
+		for _, region := range client.Regions {
+			if stringInSlice(region, r.Regions) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.ASNs) > 0 || len(r.ASNRanges) > 0 {
+		if client.ASN == nil {
+			return false
+		}
+		return r.matchesASN(client.ASN.Number)
+	}
+	return true
+}
+
+func (r *policyRule) matchesASN(number uint) bool {
+	for _, asn := range r.ASNs {
+		if asn == number {
+			return true
+		}
+	}
+	for _, rng := range r.ASNRanges {
+		if number >= rng[0] && number <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+type policyFile struct {
+	Pools map[string]*gatewaySet `json:"pools"`
+	Rules []*policyRule          `json:"rules"`
+}
+
+// routingPolicy holds the rules of the policy file, evaluated in order
+type routingPolicy struct {
+	path  string
+	mu    sync.RWMutex
+	rules []*policyRule
+}
+
+func loadRoutingPolicy(path string) (*routingPolicy, error) {
+	p := &routingPolicy{path: path}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *routingPolicy) load() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pf policyFile
+	if err := json.NewDecoder(f).Decode(&pf); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", p.path, err)
+	}
+	for name, set := range pf.Pools {
+		normalizeSet(set)
+		if set.empty() {
+			return fmt.Errorf("pool %s is empty", name)
+		}
+	}
+	names := make(map[string]bool)
+	for i, r := range pf.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicated rule name %s", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.compile(pf.Pools); err != nil {
+			return fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.rules = pf.Rules
+	p.mu.Unlock()
+	return nil
+}
+
+func normalizeSet(set *gatewaySet) {
+	for i := range set.Locations {
+		set.Locations[i] = strings.ToLower(set.Locations[i])
+	}
+	for i := range set.Countries {
+		set.Countries[i] = strings.ToUpper(set.Countries[i])
+	}
+	for i := range set.Transports {
+		set.Transports[i] = strings.ToLower(set.Transports[i])
+	}
+}
+
+func (r *policyRule) compile(pools map[string]*gatewaySet) error {
+	switch r.Action {
+	case policyAllow, policyDeny, policyPrefer, policyPin:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if len(r.Countries) == 0 && len(r.ASNs) == 0 && len(r.ASNRanges) == 0 && len(r.Regions) == 0 {
+		return fmt.Errorf("needs countries, asns, asn_ranges or regions to match clients")
+	}
+	for _, rng := range r.ASNRanges {
+		if rng[0] > rng[1] {
+			return fmt.Errorf("invalid asn range %d-%d", rng[0], rng[1])
+		}
+	}
+	for i := range r.Countries {
+		r.Countries[i] = strings.ToUpper(r.Countries[i])
+	}
+	switch {
+	case r.Pool != "" && r.Gateways != nil:
+		return fmt.Errorf("has both a pool and gateways")
+	case r.Pool != "":
+		set, ok := pools[r.Pool]
+		if !ok {
+			return fmt.Errorf("unknown pool %s", r.Pool)
+		}
+		r.set = set
+	case r.Gateways != nil:
+		normalizeSet(r.Gateways)
+		if r.Gateways.empty() {
+			return fmt.Errorf("has an empty set of gateways")
+		}
+		r.set = r.Gateways
+	default:
+		return fmt.Errorf("needs a pool or gateways")
+	}
+	return nil
+}
+
+// apply evaluates the rules matching the client over the ranked hosts, and
+// returns the resulting hosts and the names of the rules that applied.
+// Filtering the ranked hosts keeps them in distance order, as if the rules
+// were evaluated before ordering. A deny rule is always enforced, even if it
+// leaves the client without any gateway, but the other rules are skipped if
+// they would.
+func (p *routingPolicy) apply(g *geodb, client *clientInfo, hosts []string) ([]string, []string) {
+	if p == nil {
+		return hosts, nil
+	}
+	p.mu.RLock()
+	rules := p.rules
+	p.mu.RUnlock()
+
+	byHost := make(map[string]gateway, len(g.Gateways))
+	for _, gw := range g.Gateways {
+		byHost[gw.Host] = gw
+	}
+	inSet := func(r *policyRule, host string) bool {
+		gw, ok := byHost[host]
+		return ok && r.set.contains(gw, g.gatewayCountry(gw))
+	}
+
+	applied := make([]string, 0)
+	for _, r := range rules {
+		if !r.matches(client) {
+			continue
+		}
+		kept := make([]string, 0, len(hosts))
+		rest := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			if inSet(r, host) {
+				kept = append(kept, host)
+			} else {
+				rest = append(rest, host)
+			}
+		}
+		var filtered []string
+		switch r.Action {
+		case policyDeny:
+			filtered = rest
+		case policyAllow, policyPin:
+			filtered = kept
+		case policyPrefer:
+			filtered = append(kept, rest...)
+		}
+		if len(filtered) == 0 && len(hosts) > 0 && r.Action != policyDeny {
+			if !client.dryRun {
+				log.Printf("policy %s would leave a client without gateways, skipping it", r.Name)
+				policySkips.WithLabelValues(r.Name).Inc()
+			}
+			continue
+		}
+
+		hosts = filtered
+		applied = append(applied, r.Name)
+		if !client.dryRun {
+			policyHits.WithLabelValues(r.Name).Inc()
+		}
+		if r.Action == policyPin {
+			break
+		}
+	}
+	return hosts, applied
+}
+
+// gatewayCountry returns the country of the location of the gateway, as
+// announced by the eip-service
+func (g *geodb) gatewayCountry(gw gateway) string {
+	return g.LocationCountries[gw.Location]
+}
+
+// checkPolicy is a dry run of the rules against the current gateways, for
+// operators to review a policy file before deploying it
+func checkPolicy(p *routingPolicy, gws []gateway, countries map[string]string) bool {
+	ok := true
+	for _, r := range p.rules {
+		members := make([]string, 0)
+		for _, gw := range gws {
+			if r.set.contains(gw, countries[gw.Location]) {
+				members = append(members, gw.Host)
+			}
+		}
+		fmt.Printf("%s: %s %v for clients in %v %v %v %v\n", r.Name, r.Action, members,
+			r.Countries, r.Regions, r.ASNs, r.ASNRanges)
+		if len(members) == 0 {
+			fmt.Printf("\twarning: rule %s matches no gateway\n", r.Name)
+			ok = false
+		}
+	}
+	return ok
+}
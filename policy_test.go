@@ -0,0 +1,76 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestPolicy(t *testing.T, rules ...*policyRule) *routingPolicy {
+	p := &routingPolicy{}
+	for _, r := range rules {
+		if err := r.compile(nil); err != nil {
+			t.Fatal(err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p
+}
+
+func TestPolicyEmptyList(t *testing.T) {
+	g := newTestGeodb(0)
+	hosts := g.sortGateways(g.rand, 48.8566, 2.3522, 0)
+	notUS := &gatewaySet{Countries: []string{"FR", "NL", "CA", "AU", "GB", "JP"}}
+
+	tests := []struct {
+		name    string
+		rule    *policyRule
+		hosts   int
+		applied string
+	}{
+		{
+			"deny is enforced",
+			&policyRule{Name: "deny-us", Countries: []string{"FR"}, Action: policyDeny, Gateways: &gatewaySet{Countries: []string{"US"}}},
+			0, "deny-most deny-us",
+		},
+		{
+			"allow is skipped",
+			&policyRule{Name: "allow-fr", Countries: []string{"FR"}, Action: policyAllow, Gateways: &gatewaySet{Countries: []string{"FR"}}},
+			6, "deny-most",
+		},
+		{
+			"pin is skipped",
+			&policyRule{Name: "pin-fr", Countries: []string{"FR"}, Action: policyPin, Gateways: &gatewaySet{Countries: []string{"FR"}}},
+			6, "deny-most",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPolicy(t,
+				&policyRule{Name: "deny-most", Countries: []string{"*"}, Action: policyDeny, Gateways: notUS},
+				tt.rule,
+			)
+			got, applied := p.apply(g, parisClient(), hosts)
+			if len(got) != tt.hosts {
+				t.Errorf("got %d gateways, want %d: %v", len(got), tt.hosts, got)
+			}
+			if strings.Join(applied, " ") != tt.applied {
+				t.Errorf("applied %v, want %s", applied, tt.applied)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"net"
+)
+
+// prefixTree is a binary trie of network prefixes supporting longest prefix
+// match. IPv4 networks are stored as IPv4-mapped IPv6 ones, so a single tree
+// holds both families.
+type prefixTree struct {
+	root *prefixNode
+	size int
+}
+
+type prefixNode struct {
+	children [2]*prefixNode
+	network  *net.IPNet
+	value    interface{}
+}
+
+func newPrefixTree() *prefixTree {
+	return &prefixTree{&prefixNode{}, 0}
+}
+
+func prefixBits(network *net.IPNet) (net.IP, int) {
+	ones, bits := network.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	return network.IP.To16(), ones
+}
+
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insert adds the network, replacing the value of an existing equal prefix
+func (t *prefixTree) insert(network *net.IPNet, value interface{}) {
+	ip, ones := prefixBits(network)
+	node := t.root
+	for i := 0; i < ones; i++ {
+		b := bitAt(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &prefixNode{}
+		}
+		node = node.children[b]
+	}
+	if node.network == nil {
+		t.size++
+	}
+	node.network = network
+	node.value = value
+}
+
+// lookup returns the most specific network containing the address
+func (t *prefixTree) lookup(ip net.IP) (*net.IPNet, interface{}) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, nil
+	}
+	var network *net.IPNet
+	var value interface{}
+	node := t.root
+	for i := 0; node != nil; i++ {
+		if node.network != nil {
+			network, value = node.network, node.value
+		}
+		if i == 8*net.IPv6len {
+			break
+		}
+		node = node.children[bitAt(ip, i)]
+	}
+	return network, value
+}
+
+func (t *prefixTree) len() int {
+	return t.size
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	quotaBuckets       = 60
+	defaultQuotaWindow = time.Hour
+	defaultMinSamples  = 100
+	// label of the quotas over all the countries in the metrics
+	allCountries = "all"
+)
+
+// countryQuota limits the share of the first positions of a gateway that go
+// to the clients of a country
+type countryQuota struct {
+	Country string  `json:"country"`
+	Host    string  `json:"host"`
+	Share   float64 `json:"share"`
+}
+
+type quotaFile struct {
+	Window     string             `json:"window"`
+	MinSamples uint64             `json:"min_samples"`
+	Gateways   map[string]float64 `json:"gateways"`
+	Countries  []countryQuota     `json:"countries"`
+}
+
+// quotaBucket counts the first positions of a slice of the window, by host
+// and by country/host
+type quotaBucket struct {
+	index  int64
+	counts map[string]uint64
+}
+
+// gatewayQuotas are soft limits on the share of first positions a gateway
+// gets over a sliding window, overall or from the clients of a country. A
+// gateway over its quota gives up the first position to the best ranked
+// gateway within its quotas.
+type gatewayQuotas struct {
+	path string
+	mu   sync.Mutex
+
+	width      time.Duration
+	minSamples uint64
+	gateways   map[string]float64
+	countries  map[string]float64
+	buckets    [quotaBuckets]quotaBucket
+}
+
+func loadGatewayQuotas(path string) (*gatewayQuotas, error) {
+	q := &gatewayQuotas{path: path}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *gatewayQuotas) load() error {
+	f, err := os.Open(q.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var qf quotaFile
+	if err := json.NewDecoder(f).Decode(&qf); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", q.path, err)
+	}
+	window := defaultQuotaWindow
+	if qf.Window != "" {
+		window, err = time.ParseDuration(qf.Window)
+		if err != nil || window < quotaBuckets*time.Second {
+			return fmt.Errorf("invalid quota window %q", qf.Window)
+		}
+	}
+	if qf.MinSamples == 0 {
+		qf.MinSamples = defaultMinSamples
+	}
+	for host, share := range qf.Gateways {
+		if share <= 0 || share > 1 {
+			return fmt.Errorf("invalid share %v for %s", share, host)
+		}
+	}
+	countries := make(map[string]float64)
+	for _, cq := range qf.Countries {
+		if cq.Share <= 0 || cq.Share > 1 {
+			return fmt.Errorf("invalid share %v for %s in %s", cq.Share, cq.Country, cq.Host)
+		}
+		countries[countryHostKey(strings.ToUpper(cq.Country), cq.Host)] = cq.Share
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if width := window / quotaBuckets; width != q.width {
+		q.width = width
+		q.buckets = [quotaBuckets]quotaBucket{}
+	}
+	q.minSamples = qf.MinSamples
+	q.gateways = qf.Gateways
+	q.countries = countries
+	return nil
+}
+
+func countryHostKey(country, host string) string {
+	return country + "/" + host
+}
+
+// total returns the count of key over the window, the mutex must be held
+func (q *gatewayQuotas) total(key string, now time.Time) uint64 {
+	current := now.UnixNano() / int64(q.width)
+	var sum uint64
+	for _, b := range q.buckets {
+		if b.counts != nil && b.index > current-quotaBuckets {
+			sum += b.counts[key]
+		}
+	}
+	return sum
+}
+
+// overQuota reports whether giving the first position to host would go over
+// one of its quotas, updating the quota pressure metrics if asked to
+func (q *gatewayQuotas) overQuota(host, country string, now time.Time, report bool) bool {
+	over := false
+	if limit, ok := q.gateways[host]; ok {
+		if all := q.total("", now); all >= q.minSamples {
+			share := float64(q.total(host, now)) / float64(all)
+			if report {
+				quotaPressure.WithLabelValues(host, allCountries).Set(share / limit)
+			}
+			over = share >= limit
+		}
+	}
+	key := countryHostKey(country, host)
+	if limit, ok := q.countries[key]; ok {
+		if all := q.total(host, now); all >= q.minSamples {
+			share := float64(q.total(key, now)) / float64(all)
+			if report {
+				quotaPressure.WithLabelValues(host, country).Set(share / limit)
+			}
+			over = over || share >= limit
+		}
+	}
+	return over
+}
+
+// apply moves the first gateway below the best ranked one within its quotas,
+// if it is over its quota. Only the responses to clients count in the
+// metrics, not the dry runs of /debug/ranking.
+func (q *gatewayQuotas) apply(client *clientInfo, hosts []string) []string {
+	if q == nil || len(hosts) < 2 {
+		return hosts
+	}
+	country := client.Record.Country.IsoCode
+	now := time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	report := !client.dryRun
+	if !q.overQuota(hosts[0], country, now, report) {
+		return hosts
+	}
+	for i, host := range hosts[1:] {
+		if !q.overQuota(host, country, now, report) {
+			if report {
+				quotaDemotions.WithLabelValues(hosts[0]).Inc()
+			}
+			ret := append([]string{host}, hosts[:i+1]...)
+			return append(ret, hosts[i+2:]...)
+		}
+	}
+	return hosts
+}
+
+// record counts the first position of a response
+func (q *gatewayQuotas) record(client *clientInfo, hosts []string) {
+	if q == nil || len(hosts) == 0 {
+		return
+	}
+	now := time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	index := now.UnixNano() / int64(q.width)
+	b := &q.buckets[index%quotaBuckets]
+	if b.counts == nil || b.index != index {
+		b.index = index
+		b.counts = make(map[string]uint64)
+	}
+	b.counts[""]++
+	b.counts[hosts[0]]++
+	b.counts[countryHostKey(client.Record.Country.IsoCode, hosts[0])]++
+}
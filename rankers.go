@@ -0,0 +1,170 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	strategyNearest         = "nearest"
+	strategyWeightedNearest = "weighted-nearest"
+	strategyLoadAware       = "load-aware"
+	strategyLatency         = "latency"
+	strategyRoundRobin      = "round-robin"
+	strategyRandom          = "random"
+)
+
+// Ranker orders the gateways for a client that has a trustable location
+type Ranker interface {
+	Rank(client *clientInfo, margin float64) []string
+}
+
+// newRankers returns the built-in strategies, by name
+func newRankers(g *geodb) map[string]Ranker {
+	return map[string]Ranker{
+		strategyNearest:         &nearestRanker{g},
+		strategyWeightedNearest: &weightedNearestRanker{g},
+		strategyLoadAware:       &loadAwareRanker{g},
+		strategyLatency:         &latencyRanker{g},
+		strategyRoundRobin:      &roundRobinRanker{g, 0},
+		strategyRandom:          &randomRanker{g},
+	}
+}
+
+// rankerFor returns the configured strategy, or the one the client was
+// given by /debug/ranking
+func (g *geodb) rankerFor(client *clientInfo) Ranker {
+	if r, ok := g.rankers[client.strategy]; ok {
+		return r
+	}
+	return g.rankers[g.strategy]
+}
+
+// nearestRanker orders by distance, shuffling equally near gateways uniformly
+type nearestRanker struct {
+	g *geodb
+}
+
+func (r *nearestRanker) Rank(client *clientInfo, margin float64) []string {
+	return r.g.orderGatewaysWith(r.g.randFor(client), r.g.clientNearest(client, margin), margin, r.g.shuffle)
+}
+
+// weightedNearestRanker orders by distance, shuffling equally near gateways
+// following their weights
+type weightedNearestRanker struct {
+	g *geodb
+}
+
+func (r *weightedNearestRanker) Rank(client *clientInfo, margin float64) []string {
+	return r.g.orderGateways(r.g.randFor(client), r.g.clientNearest(client, margin), margin)
+}
+
+// loadAwareRanker orders by distance, putting the least loaded first among
+// equally near gateways
+type loadAwareRanker struct {
+	g *geodb
+}
+
+func (r *loadAwareRanker) Rank(client *clientInfo, margin float64) []string {
+	return r.g.orderGatewaysWith(r.g.randFor(client), r.g.clientNearest(client, margin), margin, r.g.leastLoadedFirst)
+}
+
+// latencyRanker orders by the round trip times of the latency matrix, or by
+// distance for the regions without data
+type latencyRanker struct {
+	g *geodb
+}
+
+func (r *latencyRanker) Rank(client *clientInfo, margin float64) []string {
+	if hosts, ok := r.g.sortGatewaysByLatency(client, margin); ok {
+		return hosts
+	}
+	return r.g.orderGateways(r.g.randFor(client), r.g.clientNearest(client, margin), margin)
+}
+
+// roundRobinRanker ignores the location and rotates over all the gateways
+type roundRobinRanker struct {
+	g    *geodb
+	next uint64
+}
+
+func (r *roundRobinRanker) Rank(client *clientInfo, margin float64) []string {
+	hosts := r.g.pinnedGateways(r.g.gatewayHosts())
+	if len(hosts) == 0 {
+		return hosts
+	}
+	next := atomic.LoadUint64(&r.next) + 1
+	if !client.dryRun {
+		next = atomic.AddUint64(&r.next, 1)
+	}
+	start := int(next % uint64(len(hosts)))
+	return append(hosts[start:], hosts[:start]...)
+}
+
+// randomRanker ignores the location and shuffles all the gateways
+type randomRanker struct {
+	g *geodb
+}
+
+func (r *randomRanker) Rank(client *clientInfo, margin float64) []string {
+	return r.g.neutralGateways(r.g.randFor(client))
+}
+
+func (g *geodb) gatewayHosts() []string {
+	hosts := make([]string, 0, len(g.Gateways))
+	for _, gw := range g.Gateways {
+		hosts = append(hosts, gw.Host)
+	}
+	return hosts
+}
+
+func (g *geodb) shuffle(rng *rand.Rand, gws []gateway) []gateway {
+	return randomizeGateways(rng, gws)
+}
+
+func (g *geodb) leastLoadedFirst(rng *rand.Rand, gws []gateway) []gateway {
+	dest := randomizeGateways(rng, gws)
+	sort.SliceStable(dest, func(i, j int) bool {
+		return g.load.get(dest[i].Host) < g.load.get(dest[j].Host)
+	})
+	return dest
+}
+
+// lockedSource makes a rand.Source safe to share between requests, so that
+// the rankers can draw from a single, seedable, generator
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func newLockedSource(seed int64) *lockedSource {
+	return &lockedSource{src: rand.NewSource(seed)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+func parisClient() *clientInfo {
+	record := &geoip2.City{}
+	record.Country.IsoCode = "FR"
+	record.Location.Latitude = 48.8566
+	record.Location.Longitude = 2.3522
+	return &clientInfo{IP: "192.0.2.1", Record: record, Status: statusOK}
+}
+
+func TestRankers(t *testing.T) {
+	tests := []struct {
+		strategy string
+		setup    func(g *geodb)
+		check    func(t *testing.T, g *geodb, hosts []string)
+	}{
+		{
+			strategyNearest,
+			func(g *geodb) {},
+			func(t *testing.T, g *geodb, hosts []string) {
+				if !strings.HasPrefix(hosts[0], "paris") || !strings.HasPrefix(hosts[3], "london") {
+					t.Errorf("not ordered by distance: %v", hosts)
+				}
+			},
+		},
+		{
+			strategyWeightedNearest,
+			func(g *geodb) {
+				g.Weights = map[string]float64{"paris1.example.org": 0, "paris2.example.org": 0}
+			},
+			func(t *testing.T, g *geodb, hosts []string) {
+				if hosts[0] != "paris3.example.org" {
+					t.Errorf("the only weighted gateway nearby is not first: %v", hosts)
+				}
+			},
+		},
+		{
+			strategyLoadAware,
+			func(g *geodb) {
+				g.load = &gatewayLoad{load: map[string]float64{
+					"paris1.example.org": 0.9,
+					"paris2.example.org": 0.1,
+					"paris3.example.org": 0.5,
+				}}
+			},
+			func(t *testing.T, g *geodb, hosts []string) {
+				want := "paris2.example.org paris3.example.org paris1.example.org"
+				if strings.Join(hosts[:3], " ") != want {
+					t.Errorf("not ordered by load: %v", hosts)
+				}
+			},
+		},
+		{
+			strategyLatency,
+			func(g *geodb) {
+				g.latency = &latencyMatrix{rtt: map[string]map[string]float64{
+					"FR": {"tokyo": 10, "paris": 20},
+				}}
+			},
+			func(t *testing.T, g *geodb, hosts []string) {
+				if !strings.HasPrefix(hosts[0], "tokyo") || !strings.HasPrefix(hosts[3], "paris") || !strings.HasPrefix(hosts[6], "london") {
+					t.Errorf("not ordered by latency then distance: %v", hosts)
+				}
+			},
+		},
+		{
+			strategyRoundRobin,
+			func(g *geodb) {},
+			func(t *testing.T, g *geodb, hosts []string) {
+				next := g.rankers[strategyRoundRobin].Rank(parisClient(), 0)
+				if next[len(next)-1] != hosts[0] || next[0] != hosts[1] {
+					t.Errorf("not rotated: %v, then %v", hosts, next)
+				}
+			},
+		},
+		{
+			strategyRandom,
+			func(g *geodb) {},
+			func(t *testing.T, g *geodb, hosts []string) {
+				other := newTestGeodb(0)
+				other.rand = rand.New(rand.NewSource(1))
+				again := other.neutralGateways(other.rand)
+				if strings.Join(hosts, " ") != strings.Join(again, " ") {
+					t.Errorf("not reproducible with the same seed: %v, then %v", hosts, again)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			g := newTestGeodb(0)
+			g.rand = rand.New(rand.NewSource(1))
+			g.rankers = newRankers(g)
+			g.strategy = tt.strategy
+			tt.setup(g)
+
+			client := parisClient()
+			hosts := g.rankerFor(client).Rank(client, 0)
+			if len(hosts) != len(g.Gateways) {
+				t.Fatalf("got %d gateways, want %d", len(hosts), len(g.Gateways))
+			}
+			sorted := append([]string{}, hosts...)
+			sort.Strings(sorted)
+			for i := 1; i < len(sorted); i++ {
+				if sorted[i] == sorted[i-1] {
+					t.Fatalf("%s is ranked twice", sorted[i])
+				}
+			}
+			tt.check(t, g, hosts)
+		})
+	}
+}
+
+func TestRankerFor(t *testing.T) {
+	g := newTestGeodb(0)
+	g.rankers = newRankers(g)
+	g.strategy = strategyNearest
+
+	client := parisClient()
+	if _, ok := g.rankerFor(client).(*nearestRanker); !ok {
+		t.Errorf("the configured strategy is not used")
+	}
+	client.strategy = strategyRandom
+	if _, ok := g.rankerFor(client).(*randomRanker); !ok {
+		t.Errorf("the strategy given by /debug/ranking is not used")
+	}
+	client.strategy = "unknown"
+	if _, ok := g.rankerFor(client).(*nearestRanker); !ok {
+		t.Errorf("an unknown strategy doesn't fall back to the configured one")
+	}
+}
+
+func TestRoundRobinDryRun(t *testing.T) {
+	g := newTestGeodb(0)
+	r := newRankers(g)[strategyRoundRobin]
+
+	client := parisClient()
+	client.dryRun = true
+	preview := r.Rank(client, 0)
+	if again := r.Rank(client, 0); strings.Join(again, " ") != strings.Join(preview, " ") {
+		t.Errorf("a dry run advanced the rotation: %v, then %v", preview, again)
+	}
+	if live := r.Rank(parisClient(), 0); strings.Join(live, " ") != strings.Join(preview, " ") {
+		t.Errorf("a dry run doesn't preview the next rotation: %v, then %v", preview, live)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// parseWeights parses a comma-separated list of host:weight pairs
+func parseWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	if s == "" {
+		return weights, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("weights must be in the form host:weight, got %q", pair)
+		}
+		w, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid weight for %s: %s", parts[0], parts[1])
+		}
+		weights[strings.TrimSpace(parts[0])] = w
+	}
+	return weights, nil
+}
+
+func (g *geodb) weight(host string) float64 {
+	if w, ok := g.Weights[host]; ok {
+		return w
+	}
+	return 1
+}
+
+// weightedShuffle returns the gateways in random order, where gateways with a
+// higher weight are more likely to come first (Efraimidis-Spirakis sampling)
+func (g *geodb) weightedShuffle(rng *rand.Rand, gws []gateway) []gateway {
+	keys := make(map[string]float64, len(gws))
+	dest := make([]gateway, len(gws))
+	for i, gw := range randomizeGateways(rng, gws) {
+		dest[i] = gw
+		keys[gw.Host] = math.Pow(rng.Float64(), 1/g.weight(gw.Host))
+	}
+	sort.SliceStable(dest, func(i, j int) bool {
+		return keys[dest[i].Host] > keys[dest[j].Host]
+	})
+	return dest
+}
+
+// rankingMarginFor returns the distance, in km, under which two gateways are
+// considered to be equally near to the client
+func (g *geodb) rankingMarginFor(record *geoip2.City) float64 {
+	margin := g.rankingMargin
+	if g.accuracyRanking && float64(record.Location.AccuracyRadius) > margin {
+		margin = float64(record.Location.AccuracyRadius)
+	}
+	return margin
+}
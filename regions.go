@@ -0,0 +1,222 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// regionCellSize is the size in degrees of the cells of the region index
+const regionCellSize = 1.0
+
+// regionPolygon is a polygon of a named region, the first ring is the outer
+// boundary and the others are holes. Points are [lon, lat] as in GeoJSON.
+type regionPolygon struct {
+	name   string
+	rings  [][][2]float64
+	minLat float64
+	maxLat float64
+	minLon float64
+	maxLon float64
+}
+
+func newRegionPolygon(name string, rings [][][]float64) (*regionPolygon, error) {
+	if len(rings) == 0 {
+		return nil, fmt.Errorf("polygon without rings")
+	}
+	p := &regionPolygon{name: name, minLat: 90, maxLat: -90, minLon: 180, maxLon: -180}
+	for _, ring := range rings {
+		if len(ring) < 4 {
+			return nil, fmt.Errorf("ring with %d positions, at least 4 are needed", len(ring))
+		}
+		points := make([][2]float64, 0, len(ring))
+		for _, pos := range ring {
+			if len(pos) < 2 {
+				return nil, fmt.Errorf("invalid position %v", pos)
+			}
+			points = append(points, [2]float64{pos[0], pos[1]})
+		}
+		p.rings = append(p.rings, points)
+	}
+	for _, pt := range p.rings[0] {
+		p.minLon = math.Min(p.minLon, pt[0])
+		p.maxLon = math.Max(p.maxLon, pt[0])
+		p.minLat = math.Min(p.minLat, pt[1])
+		p.maxLat = math.Max(p.maxLat, pt[1])
+	}
+	return p, nil
+}
+
+func (p *regionPolygon) contains(lat, lon float64) bool {
+	if lat < p.minLat || lat > p.maxLat || lon < p.minLon || lon > p.maxLon {
+		return false
+	}
+	if !inRing(p.rings[0], lat, lon) {
+		return false
+	}
+	for _, hole := range p.rings[1:] {
+		if inRing(hole, lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRing is the even-odd rule, casting a ray towards growing longitudes
+func inRing(ring [][2]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+type geoJSONFile struct {
+	Type     string `json:"type"`
+	Features []struct {
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"features"`
+}
+
+// regionIndex finds the named regions a location is in. Polygons are
+// indexed by the cells of a grid their bounding box overlaps.
+type regionIndex struct {
+	path     string
+	mu       sync.RWMutex
+	polygons []*regionPolygon
+	cells    map[int][]int
+	names    []string
+}
+
+func loadRegions(path string) (*regionIndex, error) {
+	r := &regionIndex{path: path}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *regionIndex) load() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var gj geoJSONFile
+	if err := json.NewDecoder(f).Decode(&gj); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", r.path, err)
+	}
+	if gj.Type != "FeatureCollection" {
+		return fmt.Errorf("%s is not a FeatureCollection", r.path)
+	}
+
+	polygons := make([]*regionPolygon, 0)
+	names := make([]string, 0)
+	for i, feature := range gj.Features {
+		name, _ := feature.Properties["name"].(string)
+		if name == "" {
+			return fmt.Errorf("feature %d has no name property", i)
+		}
+		var multi [][][][]float64
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var rings [][][]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &rings)
+			multi = [][][][]float64{rings}
+		case "MultiPolygon":
+			err = json.Unmarshal(feature.Geometry.Coordinates, &multi)
+		default:
+			err = fmt.Errorf("unsupported geometry %q", feature.Geometry.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("region %s: %v", name, err)
+		}
+		for _, rings := range multi {
+			p, err := newRegionPolygon(name, rings)
+			if err != nil {
+				return fmt.Errorf("region %s: %v", name, err)
+			}
+			polygons = append(polygons, p)
+		}
+		if !stringInSlice(name, names) {
+			names = append(names, name)
+		}
+	}
+
+	cells := make(map[int][]int)
+	for i, p := range polygons {
+		for row := regionRow(p.minLat); row <= regionRow(p.maxLat); row++ {
+			for col := regionCol(p.minLon); col <= regionCol(p.maxLon); col++ {
+				key := row*regionCols + col
+				cells[key] = append(cells[key], i)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.polygons = polygons
+	r.cells = cells
+	r.names = names
+	r.mu.Unlock()
+	return nil
+}
+
+var regionCols = int(360 / regionCellSize)
+
+func regionRow(lat float64) int {
+	return int(math.Floor((lat + 90) / regionCellSize))
+}
+
+func regionCol(lon float64) int {
+	return int(math.Floor((lon + 180) / regionCellSize))
+}
+
+// lookup returns the names of the regions containing the location, in the
+// order of the file
+func (r *regionIndex) lookup(lat, lon float64) []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var regions []string
+	for _, i := range r.cells[regionRow(lat)*regionCols+regionCol(lon)] {
+		p := r.polygons[i]
+		if p.contains(lat, lon) && !stringInSlice(p.name, regions) {
+			regions = append(regions, p.name)
+		}
+	}
+	return regions
+}
+
+func (r *regionIndex) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.names)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// watchFile calls load every time the modification time of the file changes,
+// checking it every interval. The first load is left to the caller, so that
+// errors in the initial configuration can be fatal.
+func watchFile(path string, interval time.Duration, load func() error) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	go func() {
+		for range time.Tick(interval) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Printf("cannot stat %s: %v", path, err)
+				continue
+			}
+			if fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			if err := load(); err != nil {
+				log.Printf("cannot reload %s, keeping the previous version: %v", path, err)
+				continue
+			}
+			log.Printf("Reloaded %s", path)
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	statusOK         = "ok"
+	statusUnroutable = "unroutable"
+	statusUnknown    = "unknown"
+)
+
+// address ranges that are never routed on the internet, and so have no
+// location. IPv4 ones are matched also in their IPv4-mapped IPv6 form.
+var reservedRanges = []struct {
+	cidr string
+	name string
+}{
+	{"0.0.0.0/8", "this network"},
+	{"10.0.0.0/8", "private network"},
+	{"100.64.0.0/10", "carrier-grade nat"},
+	{"127.0.0.0/8", "loopback"},
+	{"169.254.0.0/16", "link-local"},
+	{"172.16.0.0/12", "private network"},
+	{"192.0.0.0/24", "protocol assignments"},
+	{"192.0.2.0/24", "documentation"},
+	{"192.168.0.0/16", "private network"},
+	{"198.18.0.0/15", "benchmarking"},
+	{"198.51.100.0/24", "documentation"},
+	{"203.0.113.0/24", "documentation"},
+	{"224.0.0.0/4", "multicast"},
+	{"240.0.0.0/4", "reserved"},
+	{"255.255.255.255/32", "broadcast"},
+	{"::/128", "unspecified"},
+	{"::1/128", "loopback"},
+	{"64:ff9b:1::/48", "local translation"},
+	{"100::/64", "discard"},
+	{"2001:db8::/32", "documentation"},
+	{"fc00::/7", "unique local"},
+	{"fe80::/10", "link-local"},
+	{"ff00::/8", "multicast"},
+}
+
+var reservedTree = newReservedTree()
+
+func newReservedTree() *prefixTree {
+	tree := newPrefixTree()
+	for _, r := range reservedRanges {
+		_, network, err := net.ParseCIDR(r.cidr)
+		if err != nil {
+			panic(err)
+		}
+		tree.insert(network, r.name)
+	}
+	return tree
+}
+
+// reservedRange returns the kind of reserved range the address belongs to,
+// or an empty string for global addresses
+func reservedRange(ip net.IP) string {
+	_, value := reservedTree.lookup(ip)
+	if value == nil {
+		return ""
+	}
+	return value.(string)
+}
+
+// parseLocation parses a "lat,lon" pair
+func parseLocation(s string) (*coordinates, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("location must be in the form lat,lon")
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("invalid latitude: %s", parts[0])
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return nil, fmt.Errorf("invalid longitude: %s", parts[1])
+	}
+	return &coordinates{lat, lon}, nil
+}
+
+// unlocatedGateways ranks the gateways for clients we could not place, from
+// the configured default location if any, otherwise in random order so that
+// they are spread over all the gateways
+func (g *geodb) unlocatedGateways(rng *rand.Rand) []string {
+	if g.defaultLocation != nil {
+		return g.sortGateways(rng, g.defaultLocation.Latitude, g.defaultLocation.Longitude, g.rankingMargin)
+	}
+	return g.neutralGateways(rng)
+}
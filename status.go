@@ -0,0 +1,74 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type DatabaseStatusJSON struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Kind      string `json:"kind,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+	BuildDate string `json:"build_date"`
+	IPVersion uint   `json:"ip_version"`
+}
+
+type StatusJSON struct {
+	Databases []DatabaseStatusJSON `json:"databases"`
+	Gateways  int                  `json:"gateways"`
+}
+
+func databaseStatus(name string, meta maxminddb.Metadata) DatabaseStatusJSON {
+	return DatabaseStatusJSON{
+		Name:      name,
+		Type:      meta.DatabaseType,
+		BuildDate: time.Unix(int64(meta.BuildEpoch), 0).UTC().Format(time.RFC3339),
+		IPVersion: meta.IPVersion,
+	}
+}
+
+type statusHandler struct {
+	geoipdb *geodb
+}
+
+func (sh *statusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g := sh.geoipdb
+
+	// the private gateways are not for the public to know about
+	gateways := 0
+	for _, gw := range g.Gateways {
+		if !g.invites.isPrivate(gw.Host) {
+			gateways++
+		}
+	}
+	status := &StatusJSON{[]DatabaseStatusJSON{g.db.status()}, gateways}
+	if g.asn != nil {
+		status.Databases = append(status.Databases, databaseStatus("asn", g.asn.db.Metadata()))
+	}
+	if g.anon != nil {
+		status.Databases = append(status.Databases, databaseStatus("anonymous", g.anon.db.Metadata()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	dataJSON, _ := json.Marshal(status)
+	w.Write(dataJSON)
+}
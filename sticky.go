@@ -0,0 +1,107 @@
+// Copyright (c) 2018 LEAP Encryption Access Project
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const minSecret = 16
+
+// readSecret reads a secret key from a file, ignoring the surrounding spaces
+func readSecret(path string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) < minSecret {
+		return nil, fmt.Errorf("the secret in %s must be at least %d bytes long", path, minSecret)
+	}
+	return secret, nil
+}
+
+// stickyKeys seeds the ordering of equally ranked gateways with a keyed hash
+// of the client network, so that a client gets the same order during a
+// period while different clients still spread over the gateways. The period
+// number is hashed too, so the orders rotate even if the secret doesn't.
+type stickyKeys struct {
+	path   string
+	period time.Duration
+	mu     sync.RWMutex
+	secret []byte
+}
+
+// newStickyKeys reads the secret from path, or makes a random one that lasts
+// until the service restarts if there is no path
+func newStickyKeys(path string, period time.Duration) (*stickyKeys, error) {
+	s := &stickyKeys{path: path, period: period}
+	if path == "" {
+		s.secret = make([]byte, 32)
+		_, err := crand.Read(s.secret)
+		return s, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *stickyKeys) load() error {
+	secret, err := readSecret(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.secret = secret
+	s.mu.Unlock()
+	return nil
+}
+
+// seed returns the seed for the network of ip at the time now
+func (s *stickyKeys) seed(ip net.IP, now time.Time) int64 {
+	s.mu.RLock()
+	mac := hmac.New(sha256.New, s.secret)
+	s.mu.RUnlock()
+
+	var epoch [8]byte
+	binary.BigEndian.PutUint64(epoch[:], uint64(now.UnixNano()/int64(s.period)))
+	mac.Write(epoch[:])
+	mac.Write([]byte(cacheKey(ip)))
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+// randFor returns the generator to order the gateways of the client with,
+// the shared one unless the ordering is sticky
+func (g *geodb) randFor(client *clientInfo) *rand.Rand {
+	ip := net.ParseIP(client.IP)
+	if g.sticky == nil || ip == nil {
+		if client.dryRun {
+			return rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		return g.rand
+	}
+	return rand.New(rand.NewSource(g.sticky.seed(ip, time.Now())))
+}